@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// A build checked out and ready to run. Remote agents receive it as JSON,
+// along with a tarball of its directory.
+type BuildJob struct {
+	Build      *Build
+	Repository *Repository
+	Config     *BuildConfig // nil for builds with just a Seafile
+	Secrets    map[string]string
+	Timeout    time.Duration // zero means no limit
+}
+
+// Runs prepared builds, either on the sea process or on a `sea agent`
+// connected to it.
+type Agent interface {
+	// Runs the job, writing its output to build.Buffer. Returns once it's
+	// finished, with the results recorded on build.Build, or with the error
+	// that prevented it from running.
+	Run(job *BuildJob, build RunningBuild) error
+}
+
+// Runs builds on the worker goroutines of the server
+type localAgent struct{}
+
+func (localAgent) Run(job *BuildJob, build RunningBuild) error {
+	return executeBuild(job, build.Buffer, build.cancel, build.abort, func() { SaveBuild(build.Build) })
+}
+
+// Runs job on the job directory, keeping the results on job.Build. Shared by
+// every agent, it's the part of a build that runs where its files are. Always
+// steps are only stopped by abort once the build was canceled.
+func executeBuild(job *BuildJob, output io.Writer, cancel, abort <-chan struct{}, stepDone func()) error {
+	build, config := job.Build, job.Config
+	directory := build.Path
+
+	executor, err := NewExecutor(job.Repository)
+	if err != nil {
+		return err
+	}
+	var secretValues []string
+	for _, value := range job.Secrets {
+		secretValues = append(secretValues, value)
+	}
+
+	var timeout <-chan time.Time
+	if job.Timeout > 0 {
+		timer := time.NewTimer(job.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	env := buildEnv(job.Repository, build, job.Secrets)
+	if config != nil && len(config.Caches) > 0 {
+		env = append(env, cacheEnv(directory, config.Caches)...)
+		if e := restoreCaches(job.Repository, directory, config.Caches); e != nil {
+			log.Printf("Build %d: could not restore caches: %v", build.Id, e)
+			fmt.Fprintf(output, "==> could not restore caches: %v\n", e)
+		}
+	}
+	run := &buildRun{
+		build:    build,
+		output:   output,
+		executor: executor,
+		env:      env,
+		secrets:  secretValues,
+		cancel:   cancel,
+		abort:    abort,
+		timeout:  timeout,
+		stepDone: stepDone,
+	}
+	if err = run.run(config); err != nil {
+		return err
+	}
+	if build.State == BuildTimedOut {
+		build.Error = fmt.Sprintf("timed out after %v", time.Since(build.StartedAt))
+	}
+
+	if config != nil && len(config.Artifacts) > 0 {
+		if e := collectArtifacts(build, config.Artifacts); e != nil {
+			log.Printf("Build %d: could not collect artifacts: %v", build.Id, e)
+			fmt.Fprintf(output, "==> could not collect artifacts: %v\n", e)
+		}
+	}
+	if config != nil && len(config.Caches) > 0 && build.State == BuildSuccess {
+		if e := saveCaches(job.Repository, directory, config.Caches); e != nil {
+			log.Printf("Build %d: could not save caches: %v", build.Id, e)
+			fmt.Fprintf(output, "==> could not save caches: %v\n", e)
+		}
+	}
+	if config != nil && len(config.TestReports) > 0 {
+		if e := collectTestReports(build, config.TestReports); e != nil {
+			log.Printf("Build %d: could not read test reports: %v", build.Id, e)
+			fmt.Fprintf(output, "==> could not read test reports: %v\n", e)
+		}
+	}
+	return nil
+}
+
+// Waits for agent to run the build, saving the results on the database. The
+// caller keeps build on RunningBuilds from the moment it was popped.
+func runJob(build RunningBuild, job *BuildJob, agent Agent) error {
+	// TODO: how to notify users of errors that ocurred before the build started
+	// to execute?
+	build.State = BuildRunning
+	build.StartedAt = time.Now()
+	SaveBuild(build.Build)
+	QueueCommitStatus(build.Build)
+	EmitBuildEvent(EventBuildStarted, build.Build)
+	defer SaveBuild(build.Build)
+	defer func() { build.FinishedAt = time.Now() }()
+
+	defer func() {
+		build.Buffer.End()
+		build.Output = build.Buffer.Bytes()
+	}()
+
+	select {
+	case <-build.cancel:
+		// While it was being prepared
+		build.State = BuildCanceled
+		return nil
+	default:
+	}
+	return agent.Run(job, build)
+}
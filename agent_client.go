@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// `sea agent` runs builds claimed from a sea server, with its own executor,
+// caches and work directory. The server keeps the database and the output.
+func RunAgent(args []string) int {
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	server := flags.String("server", "http://localhost:8080", "url of the sea server")
+	token := flags.String("token", os.Getenv("SEA_AGENT_TOKEN"), "agent token set on the server (default $SEA_AGENT_TOKEN)")
+	hostname, _ := os.Hostname()
+	name := flags.String("name", hostname, "name shown on builds run by this agent")
+	labels := flags.String("labels", runtime.GOOS, "labels offered by this agent, separated by commas")
+	work := flags.String("work", "./tmp/agent", "directory to check out builds")
+	flags.StringVar(&Config.Executor, "executor", "local", "default executor of builds: local, sandbox (bubblewrap) or container")
+	flags.StringVar(&Config.ContainerRuntime, "container-runtime", "docker", "docker compatible CLI used by the container executor")
+	flags.StringVar(&Config.ContainerImage, "container-image", "", "default image of the container executor")
+	flags.StringVar(&Config.CachePath, "caches", "./tmp/agent/caches", "directory to store build caches")
+	flags.Int64Var(&Config.CacheLimit, "cache-limit", 1<<30, "maximum size in bytes of each build cache, 0 for no limit")
+	flags.DurationVar(&Config.KillGrace, "kill-grace", 10*time.Second, "time between SIGTERM and SIGKILL when stopping a build")
+	flags.DurationVar(&Config.AlwaysGrace, "always-grace", 10*time.Minute, "time always steps get to run after the build failed, was canceled or timed out")
+	flags.Parse(args)
+
+	if *token == "" {
+		log.Print("-token is required")
+		return 1
+	}
+	if _, err := parseLabels(*labels); err != nil {
+		log.Print(err)
+		return 1
+	}
+	if !validExecutor(Config.Executor) {
+		log.Printf("unknown executor %q", Config.Executor)
+		return 1
+	}
+	Config.BaseUrl = strings.TrimSuffix(*server, "/")
+	// Artifacts are collected here before being uploaded to the server
+	Config.ArtifactsPath = *work + "/artifacts"
+	for _, dir := range [...]string{*work, Config.ArtifactsPath, Config.CachePath} {
+		if err := os.MkdirAll(dir, 0775); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+
+	client := &agentClient{
+		server: Config.BaseUrl,
+		token:  *token,
+		name:   *name,
+		labels: *labels,
+		work:   *work,
+		quit:   make(chan struct{}),
+	}
+	killed := make(chan os.Signal, 1)
+	signal.Notify(killed, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		client.loop()
+		close(done)
+	}()
+
+	log.Printf("Agent %q running builds of %s", client.name, client.server)
+	select {
+	case sig := <-killed:
+		log.Printf("Catched signal %q. Exiting...", sig)
+		close(client.quit)
+		<-done
+		return 130
+	case <-done:
+		return 0
+	}
+}
+
+type agentClient struct {
+	server string
+	token  string
+	name   string
+	labels string
+	work   string
+
+	// Closed to stop claiming builds and cancel the running one
+	quit chan struct{}
+}
+
+func (c *agentClient) loop() {
+	for {
+		select {
+		case <-c.quit:
+			return
+		default:
+		}
+		job, err := c.claim()
+		if err != nil {
+			log.Print("claim: ", err)
+			select {
+			case <-time.After(5 * time.Second):
+			case <-c.quit:
+				return
+			}
+			continue
+		}
+		if job != nil {
+			c.run(job)
+		}
+	}
+}
+
+func (c *agentClient) request(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.server+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, &agentRequestError{
+			StatusCode: res.StatusCode,
+			message:    fmt.Sprintf("%s %s: %s: %s", method, path, res.Status, bytes.TrimSpace(message)),
+		}
+	}
+	return res, nil
+}
+
+type agentRequestError struct {
+	StatusCode int
+	message    string
+}
+
+// error
+func (e *agentRequestError) Error() string {
+	return e.message
+}
+
+// Returns nil when no build was queued before the server gave up waiting
+func (c *agentClient) claim() (*BuildJob, error) {
+	query := url.Values{"name": {c.name}, "labels": {c.labels}}
+	res, err := c.request("POST", "/agent/claim?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	job := new(BuildJob)
+	return job, json.NewDecoder(res.Body).Decode(job)
+}
+
+func (c *agentClient) run(job *BuildJob) {
+	build := job.Build
+	log.Printf("Running build #%d of %q", build.Id, job.Repository.Name)
+	prefix := fmt.Sprintf("/agent/builds/%d", build.Id)
+	report := agentReport{}
+
+	output := new(agentOutput)
+	// Mirrors the cancel and abort of the build on the server
+	stopper := NewRunningBuild(build)
+	stop := make(chan struct{})
+	sent := make(chan struct{})
+	go func() {
+		c.sendOutput(prefix, output, stop, stopper)
+		close(sent)
+	}()
+	go func() {
+		select {
+		case <-c.quit:
+			stopper.Abort()
+		case <-sent:
+		}
+	}()
+
+	err := c.execute(prefix, job, output, stopper.cancel, stopper.abort)
+	close(stop)
+	<-sent
+	if err != nil {
+		log.Printf("Build #%d failed to run: %v", build.Id, err)
+		report.Failure = err.Error()
+	} else {
+		report.State = build.State
+		report.ReturnCode = build.ReturnCode
+		report.Error = build.Error
+		report.Steps = build.Steps
+		report.Artifacts = build.Artifacts
+		report.Tests = build.Tests
+		if len(build.Artifacts) > 0 {
+			if err = c.uploadArtifacts(prefix, build); err != nil {
+				log.Printf("Build #%d: could not upload artifacts: %v", build.Id, err)
+				report.Artifacts = nil
+			}
+		}
+	}
+
+	body, _ := json.Marshal(&report)
+	res, err := c.request("POST", prefix+"/finish", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Build #%d: could not report results: %v", build.Id, err)
+		return
+	}
+	res.Body.Close()
+}
+
+// Downloads the build files and runs it
+func (c *agentClient) execute(prefix string, job *BuildJob, output io.Writer, cancel, abort <-chan struct{}) error {
+	directory, err := ioutil.TempDir(c.work, fmt.Sprintf("sea_%d_", job.Repository.Id))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(directory)
+	// Steps run inside it, so relative paths would not resolve
+	if directory, err = filepath.Abs(directory); err != nil {
+		return err
+	}
+	res, err := c.request("GET", prefix+"/source", nil)
+	if err != nil {
+		return err
+	}
+	err = extractTar(res.Body, directory, true)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	job.Build.Path = directory
+	job.Build.StartedAt = time.Now()
+	return executeBuild(job, output, cancel, abort, nil)
+}
+
+// Posts the output every second until stop is closed, which also works as a
+// heartbeat. Cancels or aborts build as the server asks.
+func (c *agentClient) sendOutput(prefix string, output *agentOutput, stop <-chan struct{}, build RunningBuild) {
+	// Repeated on every post, unlike a second cancel on the server
+	cancel := func() { build.once.Do(func() { close(build.cancel) }) }
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		last := false
+		select {
+		case <-ticker.C:
+		case <-stop:
+			last = true
+		}
+		data := output.pending()
+		res, err := c.request("POST", prefix+"/output", bytes.NewReader(data))
+		if err != nil {
+			// Kept to be sent again, unless the server forgot about the build
+			log.Print(err)
+			if e, ok := err.(*agentRequestError); ok && e.StatusCode == http.StatusNotFound {
+				build.Abort()
+			}
+		} else {
+			output.sent(len(data))
+			var response struct{ Cancel, Abort bool }
+			json.NewDecoder(res.Body).Decode(&response)
+			res.Body.Close()
+			if response.Abort {
+				build.Abort()
+			} else if response.Cancel {
+				cancel()
+			}
+		}
+		if last {
+			return
+		}
+	}
+}
+
+func (c *agentClient) uploadArtifacts(prefix string, build *Build) error {
+	store := artifactsDir(build)
+	defer os.RemoveAll(store)
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeTar(writer, store))
+	}()
+	res, err := c.request("PUT", prefix+"/artifacts", reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Output of a build waiting to be sent to the server
+type agentOutput struct {
+	sync.Mutex
+	data []byte
+}
+
+// io.Writer
+func (o *agentOutput) Write(p []byte) (int, error) {
+	o.Lock()
+	o.data = append(o.data, p...)
+	o.Unlock()
+	return len(p), nil
+}
+
+func (o *agentOutput) pending() []byte {
+	o.Lock()
+	defer o.Unlock()
+	return append([]byte(nil), o.data...)
+}
+
+func (o *agentOutput) sent(n int) {
+	o.Lock()
+	o.data = o.data[n:]
+	o.Unlock()
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// JSON API for scripts and bots, under /api/v1:
+//
+//	GET    /api/v1/repositories
+//	POST   /api/v1/repositories
+//	GET    /api/v1/repositories/:id
+//	PATCH  /api/v1/repositories/:id
+//	DELETE /api/v1/repositories/:id
+//	GET    /api/v1/builds?repository=1&state=failed&branch=master&page=2&per_page=50
+//	POST   /api/v1/repositories/:id/builds
+//	GET    /api/v1/repositories/:id/builds/:number
+//	GET    /api/v1/repositories/:id/builds/:number/log
+//	POST   /api/v1/repositories/:id/builds/:number/cancel
+//
+// Jobs of a matrix build are reached by appending /jobs/:job to the build.
+// Request bodies are JSON too, and errors look like
+//
+//	{"error": "Invalid repository", "errors": ["Name can't be blank"]}
+//
+// When Config.ApiToken is set, requests must send it as a bearer token.
+func apiHandler(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if Config.ApiToken != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !validToken(Config.ApiToken, token) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="sea"`)
+				writeApiError(w, http.StatusUnauthorized, "Invalid API token")
+				return
+			}
+		}
+		h(w, r, ps)
+	}
+}
+
+type apiError struct {
+	Error  string   `json:"error"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		panic(err)
+	}
+}
+
+func writeApiError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, apiError{Error: fmt.Sprintf(format, args...)})
+}
+
+// Request bodies are limited to 1MB
+func readJSON(w http.ResponseWriter, r *http.Request, value interface{}) bool {
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(value); err != nil {
+		writeApiError(w, http.StatusBadRequest, "Invalid JSON body: %v", err)
+		return false
+	}
+	return true
+}
+
+func findApiRepositoryParam(w http.ResponseWriter, r *http.Request, ps httprouter.Params) *Repository {
+	id, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, "Invalid `id` parameter")
+		return nil
+	}
+	repository := FindRepository(id)
+	if repository == nil {
+		writeApiError(w, http.StatusNotFound, "Repository %d not found", id)
+	}
+	return repository
+}
+
+func findApiBuildParams(w http.ResponseWriter, r *http.Request, ps httprouter.Params) *Build {
+	repository := findApiRepositoryParam(w, r, ps)
+	if repository == nil {
+		return nil
+	}
+	number, err := strconv.Atoi(ps.ByName("number"))
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, "Invalid `number` parameter")
+		return nil
+	}
+	job := 0
+	if param := ps.ByName("job"); param != "" {
+		job, err = strconv.Atoi(param)
+		if err != nil || job < 1 {
+			writeApiError(w, http.StatusBadRequest, "Invalid `job` parameter")
+			return nil
+		}
+	}
+	build := FindJob(repository.Id, number, job)
+	if build == nil {
+		writeApiError(w, http.StatusNotFound, "Build %d of %q not found", number, repository.Name)
+	}
+	return build
+}
+
+// Secrets and the token of the status provider are never sent back
+type apiRepository struct {
+	Id             int                `json:"id"`
+	Name           string             `json:"name"`
+	Remote         bool               `json:"remote"`
+	Url            string             `json:"url,omitempty"`
+	BuildTimeout   string             `json:"build_timeout,omitempty"` // like "30m", the -build-timeout of sea when empty
+	Env            map[string]string  `json:"env,omitempty"`
+	Executor       string             `json:"executor,omitempty"`
+	Image          string             `json:"image,omitempty"`
+	DisableNetwork bool               `json:"disable_network"`
+	Labels         []string           `json:"labels,omitempty"`
+	StatusProvider string             `json:"status_provider,omitempty"`
+	StatusRepo     string             `json:"status_repo,omitempty"`
+	StatusApiUrl   string             `json:"status_api_url,omitempty"`
+	StatusUser     string             `json:"status_user,omitempty"`
+	StatusToken    bool               `json:"status_token"` // whether one is set
+	Notifications  []NotificationRule `json:"notifications,omitempty"`
+}
+
+func newApiRepository(repo *Repository) *apiRepository {
+	result := &apiRepository{
+		Id:             repo.Id,
+		Name:           repo.Name,
+		Remote:         repo.Remote,
+		Url:            repo.Url,
+		Env:            repo.Env,
+		Executor:       repo.Executor,
+		Image:          repo.Image,
+		DisableNetwork: repo.DisableNetwork,
+		Labels:         repo.Labels,
+		StatusProvider: repo.StatusProvider,
+		StatusRepo:     repo.StatusRepo,
+		StatusApiUrl:   repo.StatusApiUrl,
+		StatusUser:     repo.StatusUser,
+		StatusToken:    len(repo.StatusToken) > 0,
+		Notifications:  repo.Notifications,
+	}
+	if repo.BuildTimeout != 0 {
+		result.BuildTimeout = repo.BuildTimeout.String()
+	}
+	return result
+}
+
+// Body of the requests creating and updating repositories. Fields left out
+// keep their current value.
+type apiRepositoryParams struct {
+	Name           *string             `json:"name"`
+	Remote         *bool               `json:"remote"` // can't be changed after creation
+	Url            *string             `json:"url"`    // can't be changed after creation
+	BuildTimeout   *string             `json:"build_timeout"`
+	Env            *map[string]string  `json:"env"`
+	Executor       *string             `json:"executor"`
+	Image          *string             `json:"image"`
+	DisableNetwork *bool               `json:"disable_network"`
+	Labels         *[]string           `json:"labels"`
+	StatusProvider *string             `json:"status_provider"`
+	StatusRepo     *string             `json:"status_repo"`
+	StatusApiUrl   *string             `json:"status_api_url"`
+	StatusUser     *string             `json:"status_user"`
+	StatusToken    *string             `json:"status_token"` // empty to remove it
+	Notifications  *[]NotificationRule `json:"notifications"`
+}
+
+// Sets the given fields on repo, returning a message for each invalid one
+func (p *apiRepositoryParams) apply(repo *Repository) []string {
+	var errs []string
+	if p.Name != nil {
+		repo.Name = strings.TrimSpace(*p.Name)
+	}
+	if p.BuildTimeout != nil {
+		repo.BuildTimeout = 0
+		if *p.BuildTimeout != "" {
+			var err error
+			if repo.BuildTimeout, err = time.ParseDuration(*p.BuildTimeout); err != nil {
+				errs = append(errs, fmt.Sprintf("Invalid build timeout %q", *p.BuildTimeout))
+			}
+		}
+	}
+	if p.Env != nil {
+		for name := range *p.Env {
+			if !envNameRegexp.MatchString(name) {
+				errs = append(errs, fmt.Sprintf("Invalid environment variable %q", name))
+			}
+		}
+		repo.Env = *p.Env
+	}
+	if p.Executor != nil {
+		repo.Executor = *p.Executor
+	}
+	if p.Image != nil {
+		repo.Image = strings.TrimSpace(*p.Image)
+	}
+	if p.DisableNetwork != nil {
+		repo.DisableNetwork = *p.DisableNetwork
+	}
+	if p.Labels != nil {
+		for _, label := range *p.Labels {
+			if !labelRegexp.MatchString(label) {
+				errs = append(errs, fmt.Sprintf("Invalid label %q", label))
+			}
+		}
+		repo.Labels = *p.Labels
+	}
+	if p.StatusProvider != nil {
+		repo.StatusProvider = *p.StatusProvider
+	}
+	if p.StatusRepo != nil {
+		repo.StatusRepo = strings.Trim(strings.TrimSpace(*p.StatusRepo), "/")
+	}
+	if p.StatusApiUrl != nil {
+		repo.StatusApiUrl = strings.TrimSpace(*p.StatusApiUrl)
+	}
+	if p.StatusUser != nil {
+		repo.StatusUser = strings.TrimSpace(*p.StatusUser)
+	}
+	if p.StatusToken != nil {
+		repo.StatusToken = nil
+		if *p.StatusToken != "" {
+			var err error
+			if repo.StatusToken, err = encryptSecret(*p.StatusToken); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if p.Notifications != nil {
+		for _, rule := range *p.Notifications {
+			if err := rule.Validate(); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		repo.Notifications = *p.Notifications
+	}
+	return append(errs, repo.Validate()...)
+}
+
+func apiIndexRepositoriesHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	repos := []*apiRepository{}
+	for _, repo := range AllRepositories() {
+		repos = append(repos, newApiRepository(repo))
+	}
+	writeJSON(w, http.StatusOK, repos)
+}
+
+func apiShowRepositoriesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	repository := findApiRepositoryParam(w, r, ps)
+	if repository == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, newApiRepository(repository))
+}
+
+func apiCreateRepositoriesHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var params apiRepositoryParams
+	if !readJSON(w, r, &params) {
+		return
+	}
+	repository := &Repository{WebhookSecret: NewWebhookSecret()}
+	if params.Remote != nil {
+		repository.Remote = *params.Remote
+	}
+	if params.Url != nil {
+		repository.Url = strings.TrimSpace(*params.Url)
+	}
+	if errs := params.apply(repository); len(errs) > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, apiError{"Invalid repository", errs})
+		return
+	}
+	if err := StartRepository(repository); err != nil {
+		log.Printf("Could not create repository %q: %v", repository.Name, err)
+		if e := RemoveRepository(repository); e != nil {
+			log.Print(e)
+		}
+		status := http.StatusInternalServerError
+		if repository.Remote {
+			status = http.StatusUnprocessableEntity
+		}
+		writeApiError(w, status, "Could not create the repository: %v", err)
+		return
+	}
+	EmitRepositoryEvent(EventRepositoryCreated, repository)
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/repositories/%d", repository.Id))
+	writeJSON(w, http.StatusCreated, newApiRepository(repository))
+}
+
+func apiUpdateRepositoriesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	repository := findApiRepositoryParam(w, r, ps)
+	if repository == nil {
+		return
+	}
+	var params apiRepositoryParams
+	if !readJSON(w, r, &params) {
+		return
+	}
+	errs := params.apply(repository)
+	// Sending back the current values is fine
+	if params.Remote != nil && *params.Remote != repository.Remote {
+		errs = append(errs, "Remote can't be changed")
+	}
+	if params.Url != nil && strings.TrimSpace(*params.Url) != repository.Url {
+		errs = append(errs, "Url can't be changed")
+	}
+	if len(errs) > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, apiError{"Invalid repository", errs})
+		return
+	}
+	SaveRepository(repository)
+	// Builds may be waiting for the labels that were removed
+	notifyWorkers()
+	writeJSON(w, http.StatusOK, newApiRepository(repository))
+}
+
+func apiDeleteRepositoriesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	repository := findApiRepositoryParam(w, r, ps)
+	if repository == nil {
+		return
+	}
+	if RunningBuilds.HasRepository(repository.Id) {
+		writeApiError(w, http.StatusConflict, "Repository has running builds, cancel them first")
+		return
+	}
+	err := RemoveRepository(repository)
+	if err == ErrRepositoryNotFound {
+		// Deleted by another request since it was found
+		writeApiError(w, http.StatusNotFound, "Repository %d not found", repository.Id)
+		return
+	}
+	if err != nil {
+		log.Printf("Could not remove repository %q: %v", repository.Name, err)
+		writeApiError(w, http.StatusInternalServerError, "Could not remove the repository: %v", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// A build as returned by the API, the EventBuild of webhooks with its details
+type apiBuild struct {
+	*EventBuild
+	RepositoryId     int           `json:"repository_id"`
+	Steps            []apiStep     `json:"steps,omitempty"`
+	Artifacts        []apiArtifact `json:"artifacts,omitempty"`
+	ArtifactsExpired bool          `json:"artifacts_expired,omitempty"`
+	Tests            *TestSummary  `json:"tests,omitempty"`
+	JobBuilds        []*apiBuild   `json:"job_builds,omitempty"` // jobs of a matrix build, when fetched alone
+}
+
+type apiStep struct {
+	Name         string     `json:"name"`
+	State        string     `json:"state"`
+	Skipped      bool       `json:"skipped,omitempty"`
+	AllowFailure bool       `json:"allow_failure,omitempty"`
+	ReturnCode   int        `json:"return_code"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+}
+
+type apiArtifact struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Url  string `json:"url"`
+}
+
+func newApiBuild(build *Build) *apiBuild {
+	result := &apiBuild{
+		EventBuild:       newEventBuild(build),
+		RepositoryId:     build.RepositoryId,
+		ArtifactsExpired: build.ArtifactsExpired,
+	}
+	for _, step := range build.Steps {
+		result.Steps = append(result.Steps, apiStep{
+			Name:         step.Name,
+			State:        step.State.String(),
+			Skipped:      step.Skipped,
+			AllowFailure: step.AllowFailure,
+			ReturnCode:   step.ReturnCode,
+			StartedAt:    optionalTime(step.StartedAt),
+			FinishedAt:   optionalTime(step.FinishedAt),
+		})
+	}
+	for _, artifact := range build.Artifacts {
+		result.Artifacts = append(result.Artifacts, apiArtifact{
+			Path: artifact.Path,
+			Size: artifact.Size,
+			Url:  Config.BaseUrl + build.Url() + "/artifacts/" + artifact.Path,
+		})
+	}
+	if len(build.Tests) > 0 {
+		summary := build.TestSummary()
+		result.Tests = &summary
+	}
+	return result
+}
+
+// Accepts the names of stateNames in any case, with underscores for spaces
+func parseApiState(name string) (BuildState, bool) {
+	name = strings.Replace(name, "_", " ", -1)
+	for state, stateName := range stateNames {
+		if strings.EqualFold(stateName, name) {
+			return BuildState(state), true
+		}
+	}
+	return 0, false
+}
+
+const (
+	apiPerPage    = 30
+	apiMaxPerPage = 100
+)
+
+type apiBuildList struct {
+	Builds  []*apiBuild `json:"builds"`
+	Page    int         `json:"page"`
+	PerPage int         `json:"per_page"`
+	Total   int         `json:"total"` // matching builds in all pages
+}
+
+// Lists top-level builds, most recent first
+func apiIndexBuildsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := r.URL.Query()
+	intParam := func(name string, fallback int) (int, bool) {
+		value := query.Get(name)
+		if value == "" {
+			return fallback, true
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			writeApiError(w, http.StatusBadRequest, "Invalid `%s` parameter", name)
+			return 0, false
+		}
+		return n, true
+	}
+	repositoryId, ok := intParam("repository", 0)
+	if !ok {
+		return
+	}
+	page, ok := intParam("page", 1)
+	if !ok {
+		return
+	}
+	perPage, ok := intParam("per_page", apiPerPage)
+	if !ok {
+		return
+	}
+	if perPage > apiMaxPerPage {
+		perPage = apiMaxPerPage
+	}
+	var state BuildState
+	filterState := query.Get("state") != ""
+	if filterState {
+		if state, ok = parseApiState(query.Get("state")); !ok {
+			writeApiError(w, http.StatusBadRequest, "Unknown state %q", query.Get("state"))
+			return
+		}
+	}
+	branch := query.Get("branch")
+
+	var builds []*Build
+	for _, build := range TopLevelBuilds(ListBuilds()) {
+		if repositoryId != 0 && build.RepositoryId != repositoryId {
+			continue
+		}
+		if filterState && build.State != state {
+			continue
+		}
+		if branch != "" && build.Ref != "refs/heads/"+branch {
+			continue
+		}
+		builds = append(builds, build)
+	}
+
+	list := apiBuildList{Builds: []*apiBuild{}, Page: page, PerPage: perPage, Total: len(builds)}
+	// Pages past the end are empty, checked first as a huge page would
+	// overflow the offset
+	start := len(builds)
+	if page-1 < len(builds)/perPage+1 {
+		start = (page - 1) * perPage
+	}
+	for i := start; i < len(builds) && i < start+perPage; i++ {
+		list.Builds = append(list.Builds, newApiBuild(builds[i]))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func apiShowBuildsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	build := findApiBuildParams(w, r, ps)
+	if build == nil {
+		return
+	}
+	result := newApiBuild(build)
+	if build.Jobs > 0 {
+		for _, job := range BuildJobs(build) {
+			result.JobBuilds = append(result.JobBuilds, newApiBuild(job))
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// Plain text, followed until the end while the build runs
+func apiLogBuildsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	build := findApiBuildParams(w, r, ps)
+	if build == nil {
+		return
+	}
+	streamOutput(w, build)
+}
+
+// Body of the request queueing a manual build, with either field
+type apiBuildParams struct {
+	Ref   string `json:"ref"`   // branch, tag or revision
+	Build int    `json:"build"` // number of a build whose revision runs again
+}
+
+func apiCreateBuildsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	repository := findApiRepositoryParam(w, r, ps)
+	if repository == nil {
+		return
+	}
+	var params apiBuildParams
+	if !readJSON(w, r, &params) {
+		return
+	}
+
+	var build *Build
+	if params.Build != 0 {
+		previous := FindBuildByNumber(repository.Id, params.Build)
+		if previous == nil {
+			writeApiError(w, http.StatusNotFound, "Build %d of %q not found", params.Build, repository.Name)
+			return
+		}
+		build = previous.Rebuild()
+	} else if spec := strings.TrimSpace(params.Ref); spec != "" {
+		build = &Build{Trigger: TriggerManual}
+		var err error
+		build.Rev, build.Ref, err = repository.ResolveRef(spec)
+		if err != nil {
+			log.Print(err)
+			writeApiError(w, http.StatusUnprocessableEntity, "Could not resolve %q", spec)
+			return
+		}
+	} else {
+		writeApiError(w, http.StatusBadRequest, "Missing `build` or `ref`")
+		return
+	}
+
+	log.Printf("Queueing %s (%s) of %q", build.Rev, build.Ref, repository.Name)
+	EnqueueBuild(repository, build)
+	w.Header().Set("Location", "/api/v1"+build.Url())
+	writeJSON(w, http.StatusCreated, newApiBuild(build))
+}
+
+// Running builds stop asynchronously, the response has the state they were in
+func apiCancelBuildsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	build := findApiBuildParams(w, r, ps)
+	if build == nil {
+		return
+	}
+	if !CancelBuild(build) {
+		writeApiError(w, http.StatusConflict, "Build is not running")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, newApiBuild(FindBuild(build.Id)))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Artifact struct {
+	Path string // Relative to the build directory
+	Size int64
+}
+
+func artifactsDir(build *Build) string {
+	return filepath.Join(Config.ArtifactsPath, strconv.Itoa(build.Id))
+}
+
+// Copies the files matching the glob patterns, relative to the build
+// directory, to the artifact store and records them on the build.
+func collectArtifacts(build *Build, patterns []string) error {
+	root, err := filepath.Abs(build.Path)
+	if err != nil {
+		return err
+	}
+	store := artifactsDir(build)
+	seen := make(map[string]bool)
+
+	for _, pattern := range patterns {
+		if filepath.IsAbs(pattern) || strings.HasPrefix(filepath.Clean(pattern), "..") {
+			return fmt.Errorf("artifact %q is outside of the build directory", pattern)
+		}
+		matches, err := filepath.Glob(filepath.Join(root, pattern))
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			info, err := os.Lstat(match)
+			if err != nil {
+				return err
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				continue
+			}
+			// Directories on the way to the match may be symlinks too
+			resolved, err := resolveInside(root, match)
+			if err != nil {
+				return fmt.Errorf("artifact %q: %v", pattern, err)
+			}
+			rel, err := filepath.Rel(root, match)
+			if err != nil {
+				return err
+			}
+			err = copyTree(resolved, filepath.Join(store, rel), func(path string, size int64) {
+				path = filepath.Join(rel, path)
+				if !seen[path] {
+					seen[path] = true
+					build.Artifacts = append(build.Artifacts, Artifact{path, size})
+				}
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Finds the stored file of an artifact of the build
+func ArtifactFile(build *Build, path string) (string, bool) {
+	path = filepath.Clean(strings.TrimPrefix(path, "/"))
+	for _, artifact := range build.Artifacts {
+		if artifact.Path == path {
+			return filepath.Join(artifactsDir(build), path), true
+		}
+	}
+	return "", false
+}
+
+// Removes artifacts of builds finished more than Config.ArtifactRetention
+// ago. Runs every hour until quit is closed.
+func PruneArtifacts(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	if Config.ArtifactRetention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		pruneArtifacts()
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+	}
+}
+
+func pruneArtifacts() {
+	limit := time.Now().Add(-Config.ArtifactRetention)
+	for _, build := range AllBuilds() {
+		if len(build.Artifacts) == 0 || build.ArtifactsExpired || build.FinishedAt.After(limit) {
+			continue
+		}
+		if err := os.RemoveAll(artifactsDir(build)); err != nil {
+			log.Printf("Could not remove artifacts of build %d: %v", build.Id, err)
+			continue
+		}
+		build.ArtifactsExpired = true
+		SaveBuild(build)
+	}
+}
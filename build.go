@@ -1,6 +1,12 @@
 package main
 
-import "time"
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
 
 type BuildState uint
 
@@ -9,6 +15,9 @@ const (
 	BuildFailed
 	BuildCanceled
 	BuildSuccess
+	BuildQueued
+	BuildAborted
+	BuildTimedOut
 )
 
 var stateNames = [...]string{
@@ -16,6 +25,9 @@ var stateNames = [...]string{
 	"Failed",
 	"Canceled",
 	"Success",
+	"Queued",
+	"Aborted",
+	"Timed out",
 }
 
 // fmt.Stringer
@@ -23,35 +35,161 @@ func (s BuildState) String() string {
 	return stateNames[s]
 }
 
+type BuildTrigger uint
+
+const (
+	TriggerPipeHook BuildTrigger = iota
+	TriggerGitHub
+	TriggerBitbucket
+	TriggerManual
+)
+
+var triggerNames = [...]string{
+	"Git hook",
+	"GitHub",
+	"Bitbucket",
+	"Manual",
+}
+
+// fmt.Stringer
+func (t BuildTrigger) String() string {
+	return triggerNames[t]
+}
+
 type Build struct {
+	Id           int
 	RepositoryId int
+	Number       int // Sequential for each repository
 	Rev          string
+	OldRev       string
+	Ref          string
+	Trigger      BuildTrigger
+	Author       string
+	Message      string
 	State        BuildState
 	Path         string
 	Output       []byte
+	Steps        []StepResult // Only for builds with a BuildConfig
 	ReturnCode   int
+	Error        string // Why the build could not run or finish
+	QueuedAt     time.Time
 	StartedAt    time.Time
 	FinishedAt   time.Time
+	Agent        string // Name of the agent that ran the build
+
+	Artifacts        []Artifact
+	ArtifactsExpired bool
+	Tests            []TestResult
+
+	// Matrix builds have no process of their own, they run one job for each
+	// combination of the matrix variables, stored in the job's Env
+	Jobs     int
+	ParentId int
+	Job      int // Starts at 1
+	Env      map[string]string
+}
+
+func (b *Build) Url() string {
+	url := fmt.Sprintf("/repositories/%d/builds/%d", b.RepositoryId, b.Number)
+	if b.Job > 0 {
+		url += fmt.Sprintf("/jobs/%d", b.Job)
+	}
+	return url
+}
+
+// A new manual build of the same revision
+func (b *Build) Rebuild() *Build {
+	return &Build{
+		Trigger: TriggerManual,
+		Rev:     b.Rev,
+		OldRev:  b.OldRev,
+		Ref:     b.Ref,
+		Author:  b.Author,
+		Message: b.Message,
+	}
+}
+
+// Matrix variables of a job, formatted as KEY=value pairs
+func (b *Build) EnvString() string {
+	var pairs []string
+	for key, value := range b.Env {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// Short name of the ref, without the refs/heads/ or refs/tags/ prefix
+func (b *Build) RefName() string {
+	for _, prefix := range [...]string{"refs/heads/", "refs/tags/"} {
+		if strings.HasPrefix(b.Ref, prefix) {
+			return strings.TrimPrefix(b.Ref, prefix)
+		}
+	}
+	return b.Ref
+}
+
+// First line of the commit message
+func (b *Build) Subject() string {
+	return strings.SplitN(strings.TrimSpace(b.Message), "\n", 2)[0]
 }
 
 func (b *Build) Duration() time.Duration {
 	return b.FinishedAt.Sub(b.StartedAt)
 }
 
+type StepResult struct {
+	Name         string
+	State        BuildState
+	Skipped      bool
+	AllowFailure bool
+	Output       []byte
+	ReturnCode   int
+	StartedAt    time.Time
+	FinishedAt   time.Time
+}
+
+func (s *StepResult) Duration() time.Duration {
+	return s.FinishedAt.Sub(s.StartedAt)
+}
+
 type RunningBuild struct {
 	*Build
 	Buffer *OutputBuffer
 	cancel chan struct{}
+	once   *sync.Once
+
+	// Closed by a second cancel, stops the always steps that run after
+	// the first one
+	abort     chan struct{}
+	abortOnce *sync.Once
 }
 
 func NewRunningBuild(b *Build) RunningBuild {
 	return RunningBuild{
-		Build:  b,
-		Buffer: NewOutputBuffer(),
-		cancel: make(chan struct{}, 1),
+		Build:     b,
+		Buffer:    NewOutputBuffer(),
+		cancel:    make(chan struct{}, 1),
+		once:      new(sync.Once),
+		abort:     make(chan struct{}),
+		abortOnce: new(sync.Once),
 	}
 }
 
+// Safe to call more than once, calling it again aborts the build
 func (b *RunningBuild) Cancel() {
-	close(b.cancel)
+	first := false
+	b.once.Do(func() {
+		close(b.cancel)
+		first = true
+	})
+	if !first {
+		b.Abort()
+	}
+}
+
+// Cancels the build along with its always steps
+func (b *RunningBuild) Abort() {
+	b.once.Do(func() { close(b.cancel) })
+	b.abortOnce.Do(func() { close(b.abort) })
 }
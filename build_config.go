@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Optional file at the repository root describing how to build it. Without
+// it the Seafile script is executed.
+const buildConfigFile = ".sea.json"
+
+// Each job is saved, queued and reported on its own, so a few wide matrix
+// variables must not expand into thousands of them
+const maxMatrixJobs = 64
+
+type BuildConfig struct {
+	Steps []StepConfig `json:"steps"`
+
+	// Each combination of the values runs as a separate job, with the
+	// variables set in its environment
+	Matrix map[string][]string `json:"matrix"`
+
+	// Glob patterns of files kept after the build, relative to the
+	// repository root. Matched directories are kept whole.
+	Artifacts []string `json:"artifacts"`
+
+	// Glob patterns of JUnit XML or `go test -json` files to read the test
+	// results from
+	TestReports []string `json:"test_reports"`
+
+	// Directories, by name, kept between builds. They are restored before
+	// the build runs and saved after it succeeds.
+	Caches map[string]string `json:"caches"`
+}
+
+// A shell command executed with /bin/sh -c on the build directory. Steps run
+// in order and stop at the first failure, except for those marked as always,
+// which also run after a cancel or timeout.
+type StepConfig struct {
+	Name         string            `json:"name"`
+	Run          string            `json:"run"`
+	Env          map[string]string `json:"env"`
+	AllowFailure bool              `json:"allow_failure"` // failure doesn't fail the build
+	Always       bool              `json:"always"`        // runs even if the build already failed
+}
+
+// Expands the matrix into the environment of each job
+func (c *BuildConfig) MatrixEnvs() []map[string]string {
+	var keys []string
+	for key, values := range c.Matrix {
+		if len(values) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+
+	envs := []map[string]string{{}}
+	for _, key := range keys {
+		var expanded []map[string]string
+		for _, env := range envs {
+			for _, value := range c.Matrix[key] {
+				combination := map[string]string{key: value}
+				for k, v := range env {
+					combination[k] = v
+				}
+				expanded = append(expanded, combination)
+			}
+		}
+		envs = expanded
+	}
+	return envs
+}
+
+// Reads the build config from the build directory. Returns nil if the
+// repository has no config file.
+func LoadBuildConfig(directory string) (*BuildConfig, error) {
+	file, err := os.Open(filepath.Join(directory, buildConfigFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config := new(BuildConfig)
+	if err = json.NewDecoder(file).Decode(config); err != nil {
+		return nil, fmt.Errorf("%s: %v", buildConfigFile, err)
+	}
+	if err = validateCaches(config.Caches); err != nil {
+		return nil, fmt.Errorf("%s: %v", buildConfigFile, err)
+	}
+	if err = validateMatrix(config.Matrix); err != nil {
+		return nil, fmt.Errorf("%s: %v", buildConfigFile, err)
+	}
+	for i, step := range config.Steps {
+		if step.Run == "" {
+			return nil, fmt.Errorf("%s: step %d has nothing to run", buildConfigFile, i+1)
+		}
+		if step.Name == "" {
+			config.Steps[i].Name = step.Run
+		}
+	}
+	return config, nil
+}
+
+func validateMatrix(matrix map[string][]string) error {
+	jobs := 1
+	for key, values := range matrix {
+		if !envNameRegexp.MatchString(key) {
+			return fmt.Errorf("invalid matrix variable name %q", key)
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("matrix variable %q has no values", key)
+		}
+		// Checked on each step, so the product can't overflow
+		jobs *= len(values)
+		if jobs > maxMatrixJobs {
+			return fmt.Errorf("matrix has more than %d jobs", maxMatrixJobs)
+		}
+	}
+	return nil
+}
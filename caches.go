@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Serializes access to the cache store, jobs of a matrix build share the
+// caches of their repository
+var cacheLock sync.Mutex
+
+var cacheNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func repositoryCacheDir(repo *Repository) string {
+	return filepath.Join(Config.CachePath, strconv.Itoa(repo.Id))
+}
+
+// Holds the size in bytes of the named cache, written when it's saved. Cache
+// names have no dots, so it never clashes with a cache directory.
+func cacheSizeFile(repo *Repository, name string) string {
+	return filepath.Join(repositoryCacheDir(repo), name+".size")
+}
+
+func validateCaches(caches map[string]string) error {
+	for name, path := range caches {
+		if !cacheNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid cache name %q", name)
+		}
+		if path == "" || filepath.IsAbs(path) || strings.HasPrefix(filepath.Clean(path), "..") {
+			return fmt.Errorf("cache %q: %q is outside of the build directory", name, path)
+		}
+	}
+	return nil
+}
+
+// SEA_CACHE_<NAME> variables with the absolute path of each cache directory
+func cacheEnv(directory string, caches map[string]string) []string {
+	var env []string
+	for name, path := range caches {
+		key := strings.ToUpper(strings.Replace(name, "-", "_", -1))
+		abs, err := filepath.Abs(filepath.Join(directory, path))
+		if err != nil {
+			abs = filepath.Join(directory, path)
+		}
+		env = append(env, "SEA_CACHE_"+key+"="+abs)
+	}
+	return env
+}
+
+// Copies the stored caches into the build directory
+func restoreCaches(repo *Repository, directory string, caches map[string]string) error {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	for name, path := range caches {
+		stored := filepath.Join(repositoryCacheDir(repo), name)
+		if _, err := os.Stat(stored); os.IsNotExist(err) {
+			continue
+		}
+		// The checkout may have symlinks on the way
+		target, err := resolveInside(directory, filepath.Join(directory, path))
+		if err != nil {
+			return fmt.Errorf("cache %q: %v", name, err)
+		}
+		if err = copyTree(stored, target, nil); err != nil {
+			return fmt.Errorf("cache %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Stores the cache directories of the build, replacing the previous ones.
+// Caches bigger than Config.CacheLimit are not saved.
+func saveCaches(repo *Repository, directory string, caches map[string]string) error {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	for name, path := range caches {
+		source := filepath.Join(directory, path)
+		if _, err := os.Lstat(source); os.IsNotExist(err) {
+			continue
+		}
+		source, err := resolveInside(directory, source)
+		if err != nil {
+			return fmt.Errorf("cache %q: %v", name, err)
+		}
+		size, err := dirSize(source)
+		if err != nil {
+			return fmt.Errorf("cache %q: %v", name, err)
+		}
+		if Config.CacheLimit > 0 && size > Config.CacheLimit {
+			return fmt.Errorf("cache %q has %d bytes, over the limit of %d", name, size, Config.CacheLimit)
+		}
+
+		stored := filepath.Join(repositoryCacheDir(repo), name)
+		sizeFile := cacheSizeFile(repo, name)
+		if err = os.Remove(sizeFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err = os.RemoveAll(stored); err != nil {
+			return err
+		}
+		if err = copyTree(source, stored, nil); err != nil {
+			os.RemoveAll(stored)
+			return fmt.Errorf("cache %q: %v", name, err)
+		}
+		if err = ioutil.WriteFile(sizeFile, []byte(strconv.FormatInt(size, 10)), 0664); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Total size of the stored caches as recorded when they were saved, so it's
+// cheap enough for every page view and doesn't wait on builds saving caches
+func CacheSize(repo *Repository) int64 {
+	files, _ := filepath.Glob(cacheSizeFile(repo, "*"))
+	var total int64
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if size, err := strconv.ParseInt(string(data), 10, 64); err == nil {
+			total += size
+		}
+	}
+	return total
+}
+
+func ClearCache(repo *Repository) error {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	return os.RemoveAll(repositoryCacheDir(repo))
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State of a build as shown by the providers
+type CommitStatus struct {
+	Rev         string
+	State       string // pending, success, failure or error
+	Url         string // build page
+	Description string
+	Context     string // tells apart statuses of the same commit
+	Canceled    bool
+}
+
+// Posts commit statuses to a git hosting service
+type StatusProvider interface {
+	// slug is the owner/name of the repository on the provider
+	SetStatus(slug string, status CommitStatus) error
+}
+
+var statusProviderNames = [...]string{"github", "bitbucket"}
+
+func validStatusProvider(name string) bool {
+	for _, n := range statusProviderNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func NewStatusProvider(repo *Repository) (StatusProvider, error) {
+	token := ""
+	if len(repo.StatusToken) > 0 {
+		var err error
+		if token, err = decryptSecret(repo.StatusToken); err != nil {
+			return nil, err
+		}
+	}
+	switch repo.StatusProvider {
+	case "github":
+		return &githubStatusProvider{
+			apiUrl: apiUrlOr(repo.StatusApiUrl, "https://api.github.com"),
+			token:  token,
+		}, nil
+	case "bitbucket":
+		return &bitbucketStatusProvider{
+			apiUrl:   apiUrlOr(repo.StatusApiUrl, "https://api.bitbucket.org"),
+			user:     repo.StatusUser,
+			password: token,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown status provider %q", repo.StatusProvider)
+	}
+}
+
+func apiUrlOr(url, fallback string) string {
+	if url == "" {
+		return fallback
+	}
+	return strings.TrimSuffix(url, "/")
+}
+
+var statusClient = &http.Client{Timeout: 30 * time.Second}
+
+func postStatusJSON(req *http.Request) error {
+	req.Header.Set("Content-Type", "application/json")
+	res, err := statusClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL, res.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+type githubStatusProvider struct {
+	apiUrl string
+	token  string
+}
+
+// StatusProvider
+func (p *githubStatusProvider) SetStatus(slug string, status CommitStatus) error {
+	body, err := json.Marshal(map[string]string{
+		"state":       status.State,
+		"target_url":  status.Url,
+		"description": status.Description,
+		"context":     status.Context,
+	})
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/repos/%s/statuses/%s", p.apiUrl, slug, status.Rev)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "token "+p.token)
+	}
+	return postStatusJSON(req)
+}
+
+type bitbucketStatusProvider struct {
+	apiUrl   string
+	user     string
+	password string // app password
+}
+
+var bitbucketStates = map[string]string{
+	"pending": "INPROGRESS",
+	"success": "SUCCESSFUL",
+	"failure": "FAILED",
+	"error":   "FAILED",
+}
+
+// StatusProvider
+func (p *bitbucketStatusProvider) SetStatus(slug string, status CommitStatus) error {
+	state := bitbucketStates[status.State]
+	if status.Canceled {
+		state = "STOPPED"
+	}
+	body, err := json.Marshal(map[string]string{
+		"key":         status.Context,
+		"name":        status.Context,
+		"state":       state,
+		"url":         status.Url,
+		"description": status.Description,
+	})
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/2.0/repositories/%s/commit/%s/statuses/build", p.apiUrl, slug, status.Rev)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if p.user != "" {
+		req.SetBasicAuth(p.user, p.password)
+	}
+	return postStatusJSON(req)
+}
+
+// Matches the owner/name at the end of SSH and HTTP clone urls
+var repoSlugRegexp = regexp.MustCompile(`[:/]([^/:]+/[^/]+?)(\.git)?/?$`)
+
+// Owner and name of the repository on the status provider
+func (r *Repository) StatusSlug() string {
+	if r.StatusRepo != "" {
+		return r.StatusRepo
+	}
+	if match := repoSlugRegexp.FindStringSubmatch(r.Url); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+func commitState(state BuildState) string {
+	switch state {
+	case BuildQueued, BuildRunning:
+		return "pending"
+	case BuildSuccess:
+		return "success"
+	case BuildFailed:
+		return "failure"
+	default:
+		return "error"
+	}
+}
+
+type statusUpdate struct {
+	repoId int
+	status CommitStatus
+}
+
+// Later updates of the same commit and context replace pending retries
+type statusKey struct {
+	repoId  int
+	rev     string
+	context string
+}
+
+func (u statusUpdate) key() statusKey {
+	return statusKey{u.repoId, u.status.Rev, u.status.Context}
+}
+
+// Failed posts are tried again, waiting twice as long after each failure,
+// starting at statusBackoff. Statuses still pending at shutdown get
+// statusFlushTimeout in all.
+const (
+	statusAttempts     = 5
+	statusBackoff      = 10 * time.Second
+	statusFlushTimeout = 15 * time.Second
+)
+
+type statusRetry struct {
+	update  statusUpdate
+	attempt int // attempts made so far
+	at      time.Time
+}
+
+// Statuses are posted in order by a single goroutine, so a slow provider
+// never holds builds back
+var statusUpdates = make(chan statusUpdate, 256)
+
+// Queues the current state of the build to be posted, if its repository is a
+// remote one with a status provider
+func QueueCommitStatus(build *Build) {
+	repo := FindRepository(build.RepositoryId)
+	if repo == nil || !repo.Remote || repo.StatusProvider == "" {
+		return
+	}
+	context := "sea"
+	if build.Job > 0 {
+		context = fmt.Sprintf("sea (%s)", build.EnvString())
+	}
+	update := statusUpdate{repo.Id, CommitStatus{
+		Rev:         build.Rev,
+		State:       commitState(build.State),
+		Url:         Config.BaseUrl + build.Url(),
+		Description: fmt.Sprintf("Build #%d: %s", build.Number, build.State),
+		Context:     context,
+		Canceled:    build.State == BuildCanceled,
+	}}
+	select {
+	case statusUpdates <- update:
+	default:
+		log.Printf("Build %d: too many pending commit statuses, dropping %q", build.Id, update.status.State)
+	}
+}
+
+// Posts queued commit statuses until quit is closed, retrying failed ones.
+// Statuses still queued or waiting for a retry then get a last attempt, within
+// statusFlushTimeout.
+func SendCommitStatuses(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	retries := make(map[statusKey]*statusRetry)
+	post := func(update statusUpdate, attempt int) {
+		err := sendCommitStatus(update)
+		if err == nil {
+			return
+		}
+		log.Printf("Commit status of %s (attempt %d/%d): %v", update.status.Rev, attempt, statusAttempts, err)
+		if attempt < statusAttempts {
+			wait := statusBackoff << uint(attempt-1)
+			retries[update.key()] = &statusRetry{update, attempt, time.Now().Add(wait)}
+		}
+	}
+	for {
+		var retry <-chan time.Time
+		if len(retries) > 0 {
+			next := time.Time{}
+			for _, r := range retries {
+				if next.IsZero() || r.at.Before(next) {
+					next = r.at
+				}
+			}
+			retry = time.After(next.Sub(time.Now()))
+		}
+		select {
+		case update := <-statusUpdates:
+			delete(retries, update.key())
+			post(update, 1)
+		case <-retry:
+			now := time.Now()
+			for key, r := range retries {
+				if !r.at.After(now) {
+					delete(retries, key)
+					post(r.update, r.attempt+1)
+				}
+			}
+		case <-quit:
+			for {
+				select {
+				case update := <-statusUpdates:
+					retries[update.key()] = &statusRetry{update: update}
+				default:
+					flushCommitStatuses(retries)
+					return
+				}
+			}
+		}
+	}
+}
+
+func flushCommitStatuses(retries map[statusKey]*statusRetry) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, r := range retries {
+			if err := sendCommitStatus(r.update); err != nil {
+				log.Printf("Commit status of %s: %v", r.update.status.Rev, err)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(statusFlushTimeout):
+		log.Printf("Gave up posting pending commit statuses after %v", statusFlushTimeout)
+	}
+}
+
+func sendCommitStatus(update statusUpdate) error {
+	repo := FindRepository(update.repoId)
+	if repo == nil || repo.StatusProvider == "" {
+		return nil
+	}
+	slug := repo.StatusSlug()
+	if slug == "" {
+		return fmt.Errorf("no owner/name for %q", repo.Name)
+	}
+	provider, err := NewStatusProvider(repo)
+	if err != nil {
+		return err
+	}
+	return provider.SetStatus(slug, update.status)
+}
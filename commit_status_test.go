@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type postedStatus struct {
+	path string
+	auth string
+	body map[string]string
+}
+
+// Serves a fake provider api, recording the statuses posted to it
+func statusServer(t *testing.T) (*httptest.Server, <-chan postedStatus) {
+	posted := make(chan postedStatus, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			t.Errorf("method %s, want POST", r.Method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type %q, want application/json", ct)
+		}
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decoding body: %v", err)
+		}
+		posted <- postedStatus{r.URL.Path, r.Header.Get("Authorization"), body}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	return server, posted
+}
+
+var statusStateTests = []struct {
+	build     BuildState
+	github    string
+	bitbucket string
+}{
+	{BuildQueued, "pending", "INPROGRESS"},
+	{BuildRunning, "pending", "INPROGRESS"},
+	{BuildSuccess, "success", "SUCCESSFUL"},
+	{BuildFailed, "failure", "FAILED"},
+	{BuildAborted, "error", "FAILED"},
+	{BuildCanceled, "error", "STOPPED"},
+}
+
+func testStatus(state BuildState) CommitStatus {
+	return CommitStatus{
+		Rev:         "0123abc",
+		State:       commitState(state),
+		Url:         "http://sea.example/builds/1",
+		Description: "Build #1: " + state.String(),
+		Context:     "sea",
+		Canceled:    state == BuildCanceled,
+	}
+}
+
+func TestGithubStatusProvider(t *testing.T) {
+	server, posted := statusServer(t)
+	defer server.Close()
+	provider := &githubStatusProvider{apiUrl: server.URL, token: "s3cret"}
+
+	for _, test := range statusStateTests {
+		status := testStatus(test.build)
+		if err := provider.SetStatus("owner/name", status); err != nil {
+			t.Fatalf("%s: %v", test.build, err)
+		}
+		got := <-posted
+		if want := "/repos/owner/name/statuses/0123abc"; got.path != want {
+			t.Errorf("%s: path %q, want %q", test.build, got.path, want)
+		}
+		if want := "token s3cret"; got.auth != want {
+			t.Errorf("%s: Authorization %q, want %q", test.build, got.auth, want)
+		}
+		if got.body["state"] != test.github {
+			t.Errorf("%s: state %q, want %q", test.build, got.body["state"], test.github)
+		}
+		if got.body["target_url"] != status.Url || got.body["context"] != status.Context {
+			t.Errorf("%s: body %v does not match %+v", test.build, got.body, status)
+		}
+	}
+}
+
+func TestBitbucketStatusProvider(t *testing.T) {
+	server, posted := statusServer(t)
+	defer server.Close()
+	provider := &bitbucketStatusProvider{apiUrl: server.URL, user: "someone", password: "s3cret"}
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("someone", "s3cret")
+	wantAuth := req.Header.Get("Authorization")
+
+	for _, test := range statusStateTests {
+		status := testStatus(test.build)
+		if err := provider.SetStatus("owner/name", status); err != nil {
+			t.Fatalf("%s: %v", test.build, err)
+		}
+		got := <-posted
+		if want := "/2.0/repositories/owner/name/commit/0123abc/statuses/build"; got.path != want {
+			t.Errorf("%s: path %q, want %q", test.build, got.path, want)
+		}
+		if got.auth != wantAuth {
+			t.Errorf("%s: Authorization %q, want %q", test.build, got.auth, wantAuth)
+		}
+		if got.body["state"] != test.bitbucket {
+			t.Errorf("%s: state %q, want %q", test.build, got.body["state"], test.bitbucket)
+		}
+		if got.body["url"] != status.Url || got.body["key"] != status.Context {
+			t.Errorf("%s: body %v does not match %+v", test.build, got.body, status)
+		}
+	}
+}
+
+func TestStatusProviderError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Bad credentials", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	provider := &githubStatusProvider{apiUrl: server.URL}
+	if err := provider.SetStatus("owner/name", testStatus(BuildSuccess)); err == nil {
+		t.Error("SetStatus succeeded on a 401 response")
+	}
+}
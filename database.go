@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
-	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
@@ -15,52 +19,92 @@ var (
 
 	RunningBuilds RunningList
 
+	// Builds whose state InitDB changed after a crash of the previous
+	// process, so their commit statuses can be updated
+	ReconciledBuilds []*Build
+
 	// Buckets
 	dbIds          = []byte("ids")
 	dbRepositories = []byte("repositories")
 	dbBuilds       = []byte("builds")
+	dbQueue        = []byte("queue")
+	dbSecrets      = []byte("secrets")
+	dbWebhooks     = []byte("webhooks")
+	dbDeliveries   = []byte("deliveries")
+	dbJobs         = []byte("jobs")
 
-	dbBuckets = [...][]byte{dbIds, dbRepositories, dbBuilds}
+	dbBuckets = [...][]byte{dbIds, dbRepositories, dbBuilds, dbQueue, dbSecrets, dbWebhooks, dbDeliveries, dbJobs}
 )
 
 type RunningList struct {
 	sync.RWMutex
 
-	// Stores the output buffer of running builds indexed by revision hash.
-	// There is a non-zero chance that commits of different git repositories to have
-	// the same hash, but it's is very unlikely.
-	m map[string]RunningBuild
+	// Stores the output buffer of running builds indexed by build id.
+	m map[int]RunningBuild
+
+	// Set by CancelAll, builds added afterwards are aborted right away
+	closed bool
 }
 
 func (l *RunningList) Add(build RunningBuild) {
 	l.Lock()
-	l.m[build.Rev] = build
+	l.m[build.Id] = build
+	if l.closed {
+		build.Abort()
+	}
 	l.Unlock()
 }
 
-func (l *RunningList) Remove(rev string) {
+// Adds the build and counts it on wg, unless CancelAll was called already.
+// Done under the lock, so it can't race the wg.Wait that follows CancelAll.
+func (l *RunningList) Start(build RunningBuild, wg *sync.WaitGroup) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return false
+	}
+	l.m[build.Id] = build
+	wg.Add(1)
+	return true
+}
+
+func (l *RunningList) Remove(id int) {
 	l.Lock()
-	delete(l.m, rev)
+	delete(l.m, id)
 	l.Unlock()
 }
 
-func (l *RunningList) Get(rev string) (RunningBuild, bool) {
+func (l *RunningList) Get(id int) (RunningBuild, bool) {
 	l.RLock()
-	entry, ok := l.m[rev]
+	entry, ok := l.m[id]
 	l.RUnlock()
 	return entry, ok
 }
 
-func (l *RunningList) CancelAll() {
+// Tells whether a build of the repository is running
+func (l *RunningList) HasRepository(repositoryId int) bool {
 	l.RLock()
+	defer l.RUnlock()
 	for _, build := range l.m {
-		build.Cancel()
+		if build.RepositoryId == repositoryId {
+			return true
+		}
 	}
-	l.RUnlock()
+	return false
+}
+
+func (l *RunningList) CancelAll() {
+	l.Lock()
+	l.closed = true
+	for _, build := range l.m {
+		build.Abort()
+	}
+	l.Unlock()
 }
 
 func InitDB() error {
-	RunningBuilds = RunningList{sync.RWMutex{}, make(map[string]RunningBuild)}
+	RunningBuilds = RunningList{m: make(map[int]RunningBuild)}
+	ReconciledBuilds = nil
 
 	var err error
 	DB, err = bolt.Open(Config.DBPath, 0600, nil)
@@ -69,15 +113,261 @@ func InitDB() error {
 	}
 
 	return DB.Update(func(tx *bolt.Tx) error {
+		indexJobs := tx.Bucket(dbJobs) == nil
 		for _, bucket := range dbBuckets {
 			if _, e := tx.CreateBucketIfNotExists(bucket); e != nil {
 				return e
 			}
 		}
-		return nil
+		if e := migrateBuildKeys(tx); e != nil {
+			return e
+		}
+		if e := migrateBuildNumbers(tx); e != nil {
+			return e
+		}
+		if e := migrateDeliveries(tx); e != nil {
+			return e
+		}
+		if indexJobs {
+			if e := migrateJobIndex(tx); e != nil {
+				return e
+			}
+		}
+		return abortOrphanBuilds(tx)
 	})
 }
 
+// Builds still marked as running were interrupted by a crash of the previous
+// process. Mark them as aborted and, if enabled, queue them again. Queued
+// builds missing from the queue go back to it.
+func abortOrphanBuilds(tx *bolt.Tx) error {
+	onQueue := make(map[string]bool)
+	cursor := tx.Bucket(dbQueue).Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		onQueue[string(value)] = true
+	}
+
+	var orphans, lost []*Build
+	var parents []int
+	cursor = tx.Bucket(dbBuilds).Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		build := new(Build)
+		if e := gob.NewDecoder(bytes.NewReader(value)).Decode(build); e != nil {
+			return e
+		}
+		if build.State == BuildQueued && !onQueue[string(key)] {
+			lost = append(lost, build)
+			continue
+		}
+		if build.State != BuildRunning {
+			continue
+		}
+		if build.Jobs > 0 {
+			// Aggregated from its jobs, updated below
+			parents = append(parents, build.Id)
+		} else {
+			orphans = append(orphans, build)
+		}
+	}
+
+	sort.Sort(buildsById(lost))
+	for _, build := range lost {
+		log.Printf("Build %d of repository %d was queued but not on the queue, queued again", build.Id, build.RepositoryId)
+		if e := queueBuild(tx, build); e != nil {
+			return e
+		}
+	}
+
+	sort.Sort(buildsById(orphans))
+	for _, build := range orphans {
+		build.State = BuildAborted
+		build.FinishedAt = time.Now()
+		build.Error = "sea stopped while the build was running"
+
+		if Config.RequeueAborted && build.ParentId != 0 {
+			// Jobs are queued again in place, so their parent keeps one job for
+			// each combination of the matrix
+			build.Error = fmt.Sprintf("aborted at %s: %s, queued again",
+				build.FinishedAt.Format("2006-01-02 15:04"), build.Error)
+			build.State = BuildQueued
+			build.QueuedAt = time.Now()
+			build.Output = nil
+			build.Steps = nil
+			log.Printf("Job %d.%d of repository %d %s", build.Number, build.Job, build.RepositoryId, build.Error)
+			if e := queueBuild(tx, build); e != nil {
+				return e
+			}
+			continue
+		}
+		var retry *Build
+		if Config.RequeueAborted {
+			retry = &Build{
+				RepositoryId: build.RepositoryId,
+				Rev:          build.Rev,
+				OldRev:       build.OldRev,
+				Ref:          build.Ref,
+				Trigger:      build.Trigger,
+				Author:       build.Author,
+				Message:      build.Message,
+				State:        BuildQueued,
+				QueuedAt:     time.Now(),
+			}
+			if e := queueBuild(tx, retry); e != nil {
+				return e
+			}
+			build.Error += fmt.Sprintf(", queued again as #%d", retry.Number)
+		}
+
+		log.Printf("Build #%d of repository %d aborted: %s", build.Number, build.RepositoryId, build.Error)
+		if e := putBuild(tx, build); e != nil {
+			return e
+		}
+		ReconciledBuilds = append(ReconciledBuilds, build)
+		if retry != nil {
+			ReconciledBuilds = append(ReconciledBuilds, retry)
+		}
+	}
+
+	for _, id := range parents {
+		if parent, e := aggregateJobs(tx, id); e != nil {
+			return e
+		} else if parent != nil {
+			ReconciledBuilds = append(ReconciledBuilds, parent)
+		}
+	}
+	return nil
+}
+
+// Builds used to be keyed by revision, give them an id instead
+func migrateBuildKeys(tx *bolt.Tx) error {
+	builds := tx.Bucket(dbBuilds)
+	// Revision => new key
+	newKeys := make(map[string][]byte)
+	// Can't modify the bucket while iterating it
+	var oldKeys [][]byte
+	cursor := builds.Cursor()
+	for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+		if len(key) != 4 {
+			oldKeys = append(oldKeys, append([]byte(nil), key...))
+		}
+	}
+	var oldBuilds []*Build
+	for _, oldKey := range oldKeys {
+		build := new(Build)
+		if e := gob.NewDecoder(bytes.NewReader(builds.Get(oldKey))).Decode(build); e != nil {
+			return e
+		}
+		if e := builds.Delete(oldKey); e != nil {
+			return e
+		}
+		oldBuilds = append(oldBuilds, build)
+	}
+	// Ids are given in the order builds were started
+	sort.Sort(buildsByStart(oldBuilds))
+	for _, build := range oldBuilds {
+		if e := putBuild(tx, build); e != nil {
+			return e
+		}
+		newKeys[build.Rev] = buildKey(build)
+	}
+
+	queue := tx.Bucket(dbQueue)
+	queued := make(map[string][]byte)
+	cursor = queue.Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		if newKey, ok := newKeys[string(value)]; ok {
+			queued[string(key)] = newKey
+		}
+	}
+	for key, newKey := range queued {
+		if e := queue.Put([]byte(key), newKey); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Number builds created before they had per-repository numbers
+func migrateBuildNumbers(tx *bolt.Tx) error {
+	var builds []*Build
+	cursor := tx.Bucket(dbBuilds).Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		build := new(Build)
+		if e := gob.NewDecoder(bytes.NewReader(value)).Decode(build); e != nil {
+			return e
+		}
+		if build.Number == 0 {
+			builds = append(builds, build)
+		}
+	}
+	sort.Sort(buildsById(builds))
+	for _, build := range builds {
+		if e := putBuild(tx, build); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Deliveries used to share one bucket, move them to the bucket of their webhook
+func migrateDeliveries(tx *bolt.Tx) error {
+	bucket := tx.Bucket(dbDeliveries)
+	var deliveries []*Delivery
+	var oldKeys [][]byte
+	cursor := bucket.Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		if value == nil {
+			continue // a webhook bucket
+		}
+		delivery := new(Delivery)
+		if e := gob.NewDecoder(bytes.NewReader(value)).Decode(delivery); e != nil {
+			return e
+		}
+		deliveries = append(deliveries, delivery)
+		oldKeys = append(oldKeys, append([]byte(nil), key...))
+	}
+	for _, key := range oldKeys {
+		if e := bucket.Delete(key); e != nil {
+			return e
+		}
+	}
+	for _, delivery := range deliveries {
+		if tx.Bucket(dbWebhooks).Get(webhookKey(delivery.WebhookId)) == nil {
+			continue
+		}
+		hookBucket, e := bucket.CreateBucketIfNotExists(webhookKey(delivery.WebhookId))
+		if e != nil {
+			return e
+		}
+		if e = putGob(hookBucket, deliveryKey(delivery.Id), delivery); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Jobs of matrix builds were found by scanning every build, index them by
+// their parent
+func migrateJobIndex(tx *bolt.Tx) error {
+	var jobs []*Build
+	cursor := tx.Bucket(dbBuilds).Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		build := new(Build)
+		if e := gob.NewDecoder(bytes.NewReader(value)).Decode(build); e != nil {
+			return e
+		}
+		if build.ParentId != 0 {
+			jobs = append(jobs, build)
+		}
+	}
+	for _, job := range jobs {
+		if e := tx.Bucket(dbJobs).Put(jobKey(job), buildKey(job)); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
 func incrementId(tx *bolt.Tx, bucketName []byte) (id int, idBytes [4]byte, err error) {
 	idsBucket := tx.Bucket(dbIds)
 	value := idsBucket.Get(bucketName)
@@ -166,6 +456,80 @@ func FindRepository(id int) *Repository {
 	return repo
 }
 
+// Deletes the repository along with its builds, queued or not, and secrets.
+// Returns the deleted builds, found is false if there was no such repository.
+func DeleteRepository(id int) (builds []*Build, found bool) {
+	err := DB.Update(func(tx *bolt.Tx) error {
+		var key [4]byte
+		binary.LittleEndian.PutUint32(key[:], uint32(id))
+		if tx.Bucket(dbRepositories).Get(key[:]) == nil {
+			return nil
+		}
+		found = true
+		if e := tx.Bucket(dbRepositories).Delete(key[:]); e != nil {
+			return e
+		}
+		if e := tx.Bucket(dbIds).Delete(buildNumberKey(id)); e != nil {
+			return e
+		}
+
+		removed := make(map[string]bool)
+		cursor := tx.Bucket(dbBuilds).Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			build := new(Build)
+			if e := gob.NewDecoder(bytes.NewReader(v)).Decode(build); e != nil {
+				return e
+			}
+			if build.RepositoryId == id {
+				builds = append(builds, build)
+				removed[string(k)] = true
+			}
+		}
+		for _, build := range builds {
+			if e := tx.Bucket(dbBuilds).Delete(buildKey(build)); e != nil {
+				return e
+			}
+			if build.ParentId == 0 {
+				continue
+			}
+			if e := tx.Bucket(dbJobs).Delete(jobKey(build)); e != nil {
+				return e
+			}
+		}
+
+		var queued [][]byte
+		cursor = tx.Bucket(dbQueue).Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			if removed[string(v)] {
+				queued = append(queued, append([]byte(nil), k...))
+			}
+		}
+		for _, k := range queued {
+			if e := tx.Bucket(dbQueue).Delete(k); e != nil {
+				return e
+			}
+		}
+
+		var secrets [][]byte
+		prefix := secretKey(id, "")
+		cursor = tx.Bucket(dbSecrets).Cursor()
+		for k, _ := cursor.Seek(prefix); bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			secrets = append(secrets, append([]byte(nil), k...))
+		}
+		for _, k := range secrets {
+			if e := tx.Bucket(dbSecrets).Delete(k); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return builds, found
+}
+
+// Returns all builds, most recent first
 func AllBuilds() []*Build {
 	var buffer bytes.Buffer
 	var dec *gob.Decoder
@@ -194,55 +558,753 @@ func AllBuilds() []*Build {
 		panic(err)
 	}
 
+	sort.Sort(sort.Reverse(buildsById(builds)))
+	return builds
+}
+
+// Like AllBuilds, but without the Output, for listings that don't show it
+func ListBuilds() []*Build {
+	var builds []*Build
+	err := DB.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(dbBuilds).Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			build := new(Build)
+			if e := gob.NewDecoder(bytes.NewReader(v)).Decode(build); e != nil {
+				return e
+			}
+			// Dropped right away, so only one output is held at a time
+			build.Output = nil
+			builds = append(builds, build)
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	sort.Sort(sort.Reverse(buildsById(builds)))
 	return builds
 }
 
+type buildsByStart []*Build
+
+// sort.Interface
+func (s buildsByStart) Len() int           { return len(s) }
+func (s buildsByStart) Less(i, j int) bool { return s[i].StartedAt.Before(s[j].StartedAt) }
+func (s buildsByStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type buildsById []*Build
+
+// sort.Interface
+func (s buildsById) Len() int           { return len(s) }
+func (s buildsById) Less(i, j int) bool { return s[i].Id < s[j].Id }
+func (s buildsById) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Will generate a new Id if build.Id == 0
 func SaveBuild(build *Build) {
-	var err error
+	err := DB.Update(func(tx *bolt.Tx) error {
+		return putBuild(tx, build)
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func buildKey(build *Build) []byte {
+	var key [4]byte
+	binary.LittleEndian.PutUint32(key[:], uint32(build.Id))
+	return key[:]
+}
+
+// Key on the jobs bucket, the ids of the parent and the job. Big endian, so
+// the jobs of a parent sort by id after its prefix.
+func jobKey(job *Build) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint32(key, uint32(job.ParentId))
+	binary.BigEndian.PutUint32(key[4:], uint32(job.Id))
+	return key
+}
+
+func jobPrefix(parentId int) []byte {
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], uint32(parentId))
+	return prefix[:]
+}
+
+// Key on the ids bucket for the build numbers of a repository
+func buildNumberKey(repositoryId int) []byte {
+	return []byte(fmt.Sprintf("builds/%d", repositoryId))
+}
+
+func putBuild(tx *bolt.Tx, build *Build) error {
+	if build.Id == 0 {
+		id, _, e := incrementId(tx, dbBuilds)
+		if e != nil {
+			return e
+		}
+		build.Id = id
+	}
+	// Jobs of a matrix build share the number of their parent
+	if build.Number == 0 {
+		number, _, e := incrementId(tx, buildNumberKey(build.RepositoryId))
+		if e != nil {
+			return e
+		}
+		build.Number = number
+	}
+	if build.ParentId != 0 {
+		if e := tx.Bucket(dbJobs).Put(jobKey(build), buildKey(build)); e != nil {
+			return e
+		}
+	}
 	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(build); err != nil {
+		return err
+	}
+	return tx.Bucket(dbBuilds).Put(buildKey(build), buffer.Bytes())
+}
+
+// Saves the build and appends it to the end of the queue.
+func QueueBuild(build *Build) {
+	err := DB.Update(func(tx *bolt.Tx) error {
+		return queueBuild(tx, build)
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func queueBuild(tx *bolt.Tx, build *Build) error {
+	if e := putBuild(tx, build); e != nil {
+		return e
+	}
+	id, _, e := incrementId(tx, dbQueue)
+	if e != nil {
+		return e
+	}
+	// Big endian, so the cursor iterates in insertion order
+	var key [4]byte
+	binary.BigEndian.PutUint32(key[:], uint32(id))
+	return tx.Bucket(dbQueue).Put(key[:], buildKey(build))
+}
 
-	enc := gob.NewEncoder(&buffer)
-	err = enc.Encode(build)
+// Removes the oldest build accepted by accept from the queue, marking it as
+// running on agent in the same transaction, so it's never left queued but
+// off the queue. Returns nil if there is none.
+func PopQueuedBuild(agent string, accept func(*Build) bool) *Build {
+	// Most wakes find nothing to take, which needs no write transaction
+	pending := false
+	err := DB.View(func(tx *bolt.Tx) error {
+		build, remove, e := scanQueue(tx, accept)
+		pending = build != nil || len(remove) > 0
+		return e
+	})
 	if err != nil {
 		panic(err)
 	}
+	if !pending {
+		return nil
+	}
 
+	var build *Build
 	err = DB.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(dbBuilds)
-		return bucket.Put([]byte(build.Rev), buffer.Bytes())
+		var remove [][]byte
+		var e error
+		if build, remove, e = scanQueue(tx, accept); e != nil {
+			return e
+		}
+		if build != nil {
+			build.State = BuildRunning
+			build.StartedAt = time.Now()
+			build.Agent = agent
+			if e := putBuild(tx, build); e != nil {
+				return e
+			}
+		}
+		// Deleting through the cursor would skip the next entry
+		for _, key := range remove {
+			if e := tx.Bucket(dbQueue).Delete(key); e != nil {
+				return e
+			}
+		}
+		return nil
 	})
+	if err != nil {
+		panic(err)
+	}
+	return build
+}
 
+// Whether no build waits on the queue, cheaper than looking at its builds
+func QueueEmpty() bool {
+	empty := true
+	DB.View(func(tx *bolt.Tx) error {
+		key, _ := tx.Bucket(dbQueue).Cursor().First()
+		empty = key == nil
+		return nil
+	})
+	return empty
+}
+
+// Finds the oldest queued build accepted by accept, along with the queue
+// entries to remove: the build's and those of builds no longer queued
+func scanQueue(tx *bolt.Tx, accept func(*Build) bool) (*Build, [][]byte, error) {
+	var remove [][]byte
+	cursor := tx.Bucket(dbQueue).Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		value = tx.Bucket(dbBuilds).Get(value)
+		if value == nil {
+			// build was overwritten or removed
+			remove = append(remove, append([]byte(nil), key...))
+			continue
+		}
+		queued := new(Build)
+		if e := gob.NewDecoder(bytes.NewReader(value)).Decode(queued); e != nil {
+			return nil, nil, e
+		}
+		if queued.State != BuildQueued {
+			remove = append(remove, append([]byte(nil), key...))
+			continue
+		}
+		if accept(queued) {
+			remove = append(remove, append([]byte(nil), key...))
+			return queued, remove, nil
+		}
+	}
+	return nil, remove, nil
+}
+
+// Builds waiting on the queue, oldest first
+func QueuedBuilds() []*Build {
+	var builds []*Build
+	err := DB.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(dbQueue).Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			value = tx.Bucket(dbBuilds).Get(value)
+			if value == nil {
+				continue
+			}
+			build := new(Build)
+			if e := gob.NewDecoder(bytes.NewReader(value)).Decode(build); e != nil {
+				return e
+			}
+			if build.State == BuildQueued {
+				builds = append(builds, build)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return builds
+}
+
+// Removes the build from the queue and marks it as canceled. Returns false if
+// the build was not queued.
+func CancelQueuedBuild(build *Build) bool {
+	found := false
+	err := DB.Update(func(tx *bolt.Tx) error {
+		target := buildKey(build)
+		cursor := tx.Bucket(dbQueue).Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			if bytes.Equal(value, target) {
+				found = true
+				if e := cursor.Delete(); e != nil {
+					return e
+				}
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+		build.State = BuildCanceled
+		build.FinishedAt = time.Now()
+		return putBuild(tx, build)
+	})
 	if err != nil {
 		panic(err)
 	}
+	return found
 }
 
-func FindBuild(revPrefix string) *Build {
+func FindBuild(id int) *Build {
 	var build *Build
+	err := DB.View(func(tx *bolt.Tx) (e error) {
+		build, e = getBuild(tx, id)
+		return
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return build
+}
+
+func getBuild(tx *bolt.Tx, id int) (*Build, error) {
+	value := tx.Bucket(dbBuilds).Get(buildKey(&Build{Id: id}))
+	if value == nil {
+		return nil, nil
+	}
+	build := new(Build)
+	return build, gob.NewDecoder(bytes.NewReader(value)).Decode(build)
+}
+
+// Saves the matrix build and queues its jobs
+func QueueJobs(parent *Build, jobs []*Build) {
+	err := DB.Update(func(tx *bolt.Tx) error {
+		if e := putBuild(tx, parent); e != nil {
+			return e
+		}
+		for _, job := range jobs {
+			if e := queueBuild(tx, job); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Updates the state of a matrix build from the states of its jobs. Returns
+// the parent if this call is the one that finished it, nil otherwise, so jobs
+// finishing at once don't report it twice.
+func UpdateParentBuild(parentId int) *Build {
+	var parent *Build
+	err := DB.Update(func(tx *bolt.Tx) (e error) {
+		parent, e = aggregateJobs(tx, parentId)
+		return e
+	})
+	if err != nil {
+		panic(err)
+	}
+	return parent
+}
+
+// From the highest to the lowest precedence when aggregating jobs
+var aggregateStates = [...]BuildState{
+	BuildFailed,
+	BuildTimedOut,
+	BuildAborted,
+	BuildCanceled,
+}
+
+// Returns the parent if it was running and isn't anymore
+func aggregateJobs(tx *bolt.Tx, parentId int) (*Build, error) {
+	parent, e := getBuild(tx, parentId)
+	if e != nil || parent == nil {
+		return nil, e
+	}
+	wasRunning := parent.State == BuildRunning
+
+	jobs, e := getJobs(tx, parentId)
+	if e != nil {
+		return nil, e
+	}
+	states := make(map[BuildState]bool)
+	var finishedAt time.Time
+	for _, job := range jobs {
+		states[job.State] = true
+		if job.FinishedAt.After(finishedAt) {
+			finishedAt = job.FinishedAt
+		}
+	}
+
+	if states[BuildQueued] || states[BuildRunning] {
+		parent.State = BuildRunning
+	} else {
+		parent.State = BuildSuccess
+		parent.FinishedAt = finishedAt
+		for _, state := range aggregateStates {
+			if states[state] {
+				parent.State = state
+				break
+			}
+		}
+	}
+	if e := putBuild(tx, parent); e != nil {
+		return nil, e
+	}
+	if wasRunning && parent.State != BuildRunning {
+		return parent, nil
+	}
+	return nil, nil
+}
+
+func RepositoryBuilds(repositoryId int) []*Build {
+	var builds []*Build
+	for _, build := range AllBuilds() {
+		if build.RepositoryId == repositoryId {
+			builds = append(builds, build)
+		}
+	}
+	return builds
+}
+
+// Returns the builds that are not jobs of a matrix build
+func TopLevelBuilds(builds []*Build) []*Build {
+	var result []*Build
+	for _, build := range builds {
+		if build.ParentId == 0 {
+			result = append(result, build)
+		}
+	}
+	return result
+}
+
+// Returns the jobs of a matrix build, in order
+func BuildJobs(parent *Build) []*Build {
+	var jobs []*Build
+	err := DB.View(func(tx *bolt.Tx) (e error) {
+		jobs, e = getJobs(tx, parent.Id)
+		return
+	})
+	if err != nil {
+		panic(err)
+	}
+	return jobs
+}
+
+// Reads the jobs of the parent from the jobs index, in order
+func getJobs(tx *bolt.Tx, parentId int) ([]*Build, error) {
+	var jobs []*Build
+	prefix := jobPrefix(parentId)
+	cursor := tx.Bucket(dbJobs).Cursor()
+	for key, value := cursor.Seek(prefix); bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+		value = tx.Bucket(dbBuilds).Get(value)
+		if value == nil {
+			continue
+		}
+		job := new(Build)
+		if e := gob.NewDecoder(bytes.NewReader(value)).Decode(job); e != nil {
+			return nil, e
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func FindBuildByNumber(repositoryId, number int) *Build {
+	for _, build := range RepositoryBuilds(repositoryId) {
+		if build.Number == number && build.Job == 0 {
+			return build
+		}
+	}
+	return nil
+}
+
+// Finds a job of a matrix build, job 0 is the build itself
+func FindJob(repositoryId, number, job int) *Build {
+	build := FindBuildByNumber(repositoryId, number)
+	if build == nil || job == 0 {
+		return build
+	}
+	for _, j := range BuildJobs(build) {
+		if j.Job == job {
+			return j
+		}
+	}
+	return nil
+}
+
+// Finds the last finished build of the same ref before build. For jobs of a
+// matrix build, the job with the same environment, and for matrix builds the
+// previous matrix build.
+func PreviousBuild(build *Build) *Build {
+	env := build.EnvString()
+	for _, b := range RepositoryBuilds(build.RepositoryId) {
+		if b.Id >= build.Id || b.Ref != build.Ref || (b.Jobs > 0) != (build.Jobs > 0) {
+			continue
+		}
+		if b.State == BuildQueued || b.State == BuildRunning || b.EnvString() != env {
+			continue
+		}
+		return b
+	}
+	return nil
+}
 
+// Returned when a revision prefix matches more than one revision
+type AmbiguousRevError struct {
+	Prefix     string
+	Candidates []*Build // most recent build of each revision
+}
+
+// error
+func (e *AmbiguousRevError) Error() string {
+	return fmt.Sprintf("ambiguous revision prefix %q", e.Prefix)
+}
+
+// Finds the most recent build of a revision, among the builds of the
+// repository unless repositoryId is zero. Returns nil if there is none.
+func FindBuildByRev(repositoryId int, revPrefix string) (*Build, error) {
+	var candidates []*Build
+	seen := make(map[string]bool)
+	for _, b := range TopLevelBuilds(AllBuilds()) {
+		if repositoryId != 0 && b.RepositoryId != repositoryId {
+			continue
+		}
+		if !strings.HasPrefix(b.Rev, revPrefix) {
+			continue
+		}
+		// The same commit may be built by several repositories
+		key := fmt.Sprintf("%d/%s", b.RepositoryId, b.Rev)
+		if !seen[key] {
+			seen[key] = true
+			candidates = append(candidates, b)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, nil
+	case 1:
+		return candidates[0], nil
+	default:
+		return nil, &AmbiguousRevError{revPrefix, candidates}
+	}
+}
+
+// Secrets are keyed by the repository id followed by their name
+func secretKey(repositoryId int, name string) []byte {
+	key := make([]byte, 4, 4+len(name))
+	binary.LittleEndian.PutUint32(key, uint32(repositoryId))
+	return append(key, name...)
+}
+
+func SaveSecret(repositoryId int, name, value string) error {
+	encrypted, err := encryptSecret(value)
+	if err != nil {
+		return err
+	}
+	return DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dbSecrets).Put(secretKey(repositoryId, name), encrypted)
+	})
+}
+
+func DeleteSecret(repositoryId int, name string) {
+	err := DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dbSecrets).Delete(secretKey(repositoryId, name))
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func SecretNames(repositoryId int) []string {
+	var names []string
+	prefix := secretKey(repositoryId, "")
 	err := DB.View(func(tx *bolt.Tx) error {
-		cursor := tx.Bucket(dbBuilds).Cursor()
+		cursor := tx.Bucket(dbSecrets).Cursor()
+		for k, _ := cursor.Seek(prefix); bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			names = append(names, string(k[len(prefix):]))
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return names
+}
+
+// Returns the decrypted secrets of the repository, by name
+func RepositorySecrets(repositoryId int) (map[string]string, error) {
+	secrets := make(map[string]string)
+	prefix := secretKey(repositoryId, "")
+	err := DB.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(dbSecrets).Cursor()
+		for k, v := cursor.Seek(prefix); bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			value, e := decryptSecret(v)
+			if e != nil {
+				return e
+			}
+			secrets[string(k[len(prefix):])] = value
+		}
+		return nil
+	})
+	return secrets, err
+}
+
+func putGob(bucket *bolt.Bucket, key []byte, value interface{}) error {
+	var buffer bytes.Buffer
+	if e := gob.NewEncoder(&buffer).Encode(value); e != nil {
+		return e
+	}
+	return bucket.Put(key, buffer.Bytes())
+}
+
+func webhookKey(id int) []byte {
+	var key [4]byte
+	binary.LittleEndian.PutUint32(key[:], uint32(id))
+	return key[:]
+}
+
+func SaveWebhook(hook *Webhook) {
+	err := DB.Update(func(tx *bolt.Tx) (e error) {
+		if hook.Id == 0 {
+			if hook.Id, _, e = incrementId(tx, dbWebhooks); e != nil {
+				return e
+			}
+		}
+		return putGob(tx.Bucket(dbWebhooks), webhookKey(hook.Id), hook)
+	})
+	if err != nil {
+		panic(err)
+	}
+}
 
-		prefix := []byte(revPrefix)
-		key, value := cursor.Seek(prefix)
-		if key == nil {
+// Deletes the webhook along with its deliveries
+func DeleteWebhook(id int) {
+	err := DB.Update(func(tx *bolt.Tx) error {
+		if e := tx.Bucket(dbWebhooks).Delete(webhookKey(id)); e != nil {
+			return e
+		}
+		e := tx.Bucket(dbDeliveries).DeleteBucket(webhookKey(id))
+		if e == bolt.ErrBucketNotFound {
 			return nil
 		}
+		return e
+	})
+	if err != nil {
+		panic(err)
+	}
+}
 
-		// Sanity check: ensure that the prefix is not ambiguous
-		nextKey, _ := cursor.Next()
-		if bytes.HasPrefix(nextKey, prefix) {
-			return errors.New("ambiguous revision prefix")
+func FindWebhook(id int) *Webhook {
+	var hook *Webhook
+	err := DB.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(dbWebhooks).Get(webhookKey(id))
+		if value == nil {
+			return nil
 		}
+		hook = new(Webhook)
+		return gob.NewDecoder(bytes.NewReader(value)).Decode(hook)
+	})
+	if err != nil {
+		panic(err)
+	}
+	return hook
+}
 
-		build = new(Build)
-		reader := bytes.NewReader(value)
-		return gob.NewDecoder(reader).Decode(build)
+func AllWebhooks() []*Webhook {
+	var hooks []*Webhook
+	err := DB.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(dbWebhooks).Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			hook := new(Webhook)
+			if e := gob.NewDecoder(bytes.NewReader(v)).Decode(hook); e != nil {
+				return e
+			}
+			hooks = append(hooks, hook)
+		}
+		return nil
 	})
+	if err != nil {
+		panic(err)
+	}
+	sort.Sort(webhooksById(hooks))
+	return hooks
+}
+
+type webhooksById []*Webhook
+
+// sort.Interface
+func (h webhooksById) Len() int           { return len(h) }
+func (h webhooksById) Less(i, j int) bool { return h[i].Id < h[j].Id }
+func (h webhooksById) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+// Deliveries are kept in a bucket for each webhook, keyed by their big endian
+// id, so the cursor goes from the oldest to the newest
+func deliveryKey(id int) []byte {
+	var key [4]byte
+	binary.BigEndian.PutUint32(key[:], uint32(id))
+	return key[:]
+}
 
+// Saves the delivery, removing the oldest ones of its webhook past
+// maxDeliveries. Deliveries of deleted webhooks are dropped.
+func SaveDelivery(delivery *Delivery) {
+	err := DB.Update(func(tx *bolt.Tx) (e error) {
+		if tx.Bucket(dbWebhooks).Get(webhookKey(delivery.WebhookId)) == nil {
+			return nil
+		}
+		bucket, e := tx.Bucket(dbDeliveries).CreateBucketIfNotExists(webhookKey(delivery.WebhookId))
+		if e != nil {
+			return e
+		}
+		if delivery.Id != 0 {
+			return putGob(bucket, deliveryKey(delivery.Id), delivery)
+		}
+		if delivery.Id, _, e = incrementId(tx, dbDeliveries); e != nil {
+			return e
+		}
+		if e = putGob(bucket, deliveryKey(delivery.Id), delivery); e != nil {
+			return e
+		}
+		// Walk back past the ones kept, anything older goes
+		cursor := bucket.Cursor()
+		key, _ := cursor.Last()
+		for kept := 1; key != nil && kept <= maxDeliveries; kept++ {
+			key, _ = cursor.Prev()
+		}
+		var old [][]byte
+		for ; key != nil; key, _ = cursor.Prev() {
+			old = append(old, append([]byte(nil), key...))
+		}
+		for _, key := range old {
+			if e = bucket.Delete(key); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		panic(err)
 	}
+}
 
-	return build
+func FindDelivery(webhookId, id int) *Delivery {
+	var delivery *Delivery
+	err := DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dbDeliveries).Bucket(webhookKey(webhookId))
+		if bucket == nil {
+			return nil
+		}
+		value := bucket.Get(deliveryKey(id))
+		if value == nil {
+			return nil
+		}
+		delivery = new(Delivery)
+		return gob.NewDecoder(bytes.NewReader(value)).Decode(delivery)
+	})
+	if err != nil {
+		panic(err)
+	}
+	return delivery
+}
+
+// Returns the deliveries of the webhook, most recent first
+func WebhookDeliveries(webhookId int) []*Delivery {
+	var deliveries []*Delivery
+	err := DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dbDeliveries).Bucket(webhookKey(webhookId))
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+			delivery := new(Delivery)
+			if e := gob.NewDecoder(bytes.NewReader(v)).Decode(delivery); e != nil {
+				return e
+			}
+			deliveries = append(deliveries, delivery)
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return deliveries
 }
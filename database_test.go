@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestBuildJobs(t *testing.T) {
+	teardown := setupTestDB(t)
+	defer teardown()
+	other := &Build{RepositoryId: 1, Rev: "a", State: BuildSuccess}
+	SaveBuild(other)
+	parent := &Build{RepositoryId: 1, Rev: "b", State: BuildQueued}
+	SaveBuild(parent)
+	EnqueueJobs(parent, []map[string]string{{"GO": "1.4"}, {"GO": "1.5"}, {"GO": "1.6"}})
+
+	checkJobs := func() []*Build {
+		jobs := BuildJobs(parent)
+		if len(jobs) != 3 {
+			t.Fatalf("got %d jobs, want 3", len(jobs))
+		}
+		for i, job := range jobs {
+			if job.ParentId != parent.Id || job.Job != i+1 {
+				t.Errorf("jobs[%d] is job %d of build %d, want job %d of %d", i, job.Job, job.ParentId, i+1, parent.Id)
+			}
+		}
+		if job := FindJob(1, parent.Number, 2); job == nil || job.Id != jobs[1].Id {
+			t.Errorf("FindJob found %+v, want build %d", job, jobs[1].Id)
+		}
+		return jobs
+	}
+	jobs := checkJobs()
+	if BuildJobs(other) != nil {
+		t.Error("build without a matrix has jobs")
+	}
+
+	for _, job := range jobs {
+		job.State = BuildSuccess
+		SaveBuild(job)
+	}
+	if finished := UpdateParentBuild(parent.Id); finished == nil || finished.State != BuildSuccess {
+		t.Errorf("parent finished as %+v, want success", finished)
+	}
+
+	// Databases from before the index get it on start
+	err := DB.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(dbJobs)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	DB.Close()
+	if err = InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	checkJobs()
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Outgoing webhook events. Each Event is POSTed as JSON to every Webhook
+// subscribed to it, with the headers:
+//
+//	Content-Type: application/json
+//	X-Sea-Event: build.finished
+//	X-Sea-Delivery: 42
+//	X-Sea-Signature-256: sha256=<hex HMAC-SHA256 of the body, keyed with the webhook secret>
+//
+// Receivers should compute the HMAC of the raw body and compare it to the
+// signature in constant time. Redeliveries send the same body with a new
+// delivery id.
+const (
+	EventBuildQueued       = "build.queued"
+	EventBuildStarted      = "build.started"
+	EventBuildFinished     = "build.finished"
+	EventRepositoryCreated = "repository.created"
+)
+
+var eventNames = [...]string{
+	EventBuildQueued,
+	EventBuildStarted,
+	EventBuildFinished,
+	EventRepositoryCreated,
+}
+
+// Body of every event, for example:
+//
+//	{
+//	  "event": "build.finished",
+//	  "created_at": "2015-06-01T12:00:00Z",
+//	  "repository": {"id": 1, "name": "sea", "remote": true, "url": "git@github.com:owner/sea.git"},
+//	  "build": {
+//	    "id": 12, "number": 7, "state": "Failed", "trigger": "GitHub",
+//	    "ref": "refs/heads/master", "rev": "3f1c...", "old_rev": "9a0b...",
+//	    "author": "Jane <jane@example.com>", "message": "Fix the parser\n",
+//	    "return_code": 1, "url": "http://sea.example.com/repositories/1/builds/7",
+//	    "agent": "local-1", "queued_at": "...", "started_at": "...", "finished_at": "..."
+//	  }
+//	}
+//
+// "build" is absent from repository.created events.
+type Event struct {
+	Event      string          `json:"event"` // one of eventNames
+	CreatedAt  time.Time       `json:"created_at"`
+	Repository EventRepository `json:"repository"`
+	Build      *EventBuild     `json:"build,omitempty"`
+}
+
+type EventRepository struct {
+	Id     int    `json:"id"`
+	Name   string `json:"name"`
+	Remote bool   `json:"remote"`
+	Url    string `json:"url,omitempty"` // clone url of remote repositories
+}
+
+// Jobs of a matrix build carry its parent_id, their job number and env. The
+// matrix build itself has the number of jobs and finishes after all of them.
+type EventBuild struct {
+	Id         int               `json:"id"`
+	Number     int               `json:"number"`
+	State      string            `json:"state"`   // Queued, Running, Success, Failed, Canceled, Aborted or Timed out
+	Trigger    string            `json:"trigger"` // Git hook, GitHub, Bitbucket or Manual
+	Ref        string            `json:"ref,omitempty"`
+	Rev        string            `json:"rev"`
+	OldRev     string            `json:"old_rev,omitempty"`
+	Author     string            `json:"author,omitempty"`
+	Message    string            `json:"message,omitempty"`
+	ReturnCode int               `json:"return_code"`
+	Error      string            `json:"error,omitempty"` // why the build could not run or finish
+	Url        string            `json:"url"`             // build page
+	Agent      string            `json:"agent,omitempty"` // runner of the build, once started
+	Jobs       int               `json:"jobs,omitempty"`
+	ParentId   int               `json:"parent_id,omitempty"`
+	Job        int               `json:"job,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+	QueuedAt   time.Time         `json:"queued_at"`
+	StartedAt  *time.Time        `json:"started_at,omitempty"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+}
+
+func newEventRepository(repo *Repository) EventRepository {
+	event := EventRepository{Id: repo.Id, Name: repo.Name, Remote: repo.Remote}
+	if repo.Remote {
+		event.Url = repo.Url
+	}
+	return event
+}
+
+func newEventBuild(build *Build) *EventBuild {
+	return &EventBuild{
+		Id:         build.Id,
+		Number:     build.Number,
+		State:      build.State.String(),
+		Trigger:    build.Trigger.String(),
+		Ref:        build.Ref,
+		Rev:        build.Rev,
+		OldRev:     build.OldRev,
+		Author:     build.Author,
+		Message:    build.Message,
+		ReturnCode: build.ReturnCode,
+		Error:      build.Error,
+		Url:        Config.BaseUrl + build.Url(),
+		Agent:      build.Agent,
+		Jobs:       build.Jobs,
+		ParentId:   build.ParentId,
+		Job:        build.Job,
+		Env:        build.Env,
+		QueuedAt:   build.QueuedAt,
+		StartedAt:  optionalTime(build.StartedAt),
+		FinishedAt: optionalTime(build.FinishedAt),
+	}
+}
+
+// Left out of JSON when zero
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// An url receiving events
+type Webhook struct {
+	Id     int
+	Url    string
+	Secret string   // key of the X-Sea-Signature-256 HMAC
+	Events []string // all of them when empty
+}
+
+func (h *Webhook) Accepts(event string) bool {
+	return len(h.Events) == 0 || containsString(h.Events, event)
+}
+
+// One POST of an event to a webhook
+type Delivery struct {
+	Id          int
+	WebhookId   int
+	Event       string
+	Payload     []byte
+	Redelivery  bool
+	StatusCode  int    // zero when no response was received
+	Response    string // beginning of the response body
+	Error       string
+	DeliveredAt time.Time
+	Duration    time.Duration
+}
+
+func (d *Delivery) Success() bool {
+	return d.StatusCode >= 200 && d.StatusCode < 300
+}
+
+// Older deliveries of each webhook are removed from the log
+const maxDeliveries = 1000
+
+// Kept in the delivery log
+const maxDeliveryResponse = 4096
+
+var webhookDeliveries = make(chan *Delivery, 256)
+
+func EmitBuildEvent(event string, build *Build) {
+	repo := FindRepository(build.RepositoryId)
+	if repo == nil {
+		return
+	}
+	emitEvent(Event{
+		Event:      event,
+		CreatedAt:  time.Now(),
+		Repository: newEventRepository(repo),
+		Build:      newEventBuild(build),
+	})
+}
+
+func EmitRepositoryEvent(event string, repo *Repository) {
+	emitEvent(Event{
+		Event:      event,
+		CreatedAt:  time.Now(),
+		Repository: newEventRepository(repo),
+	})
+}
+
+func emitEvent(event Event) {
+	var payload []byte
+	for _, hook := range AllWebhooks() {
+		if !hook.Accepts(event.Event) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(&event); err != nil {
+				panic(err)
+			}
+		}
+		QueueDelivery(&Delivery{WebhookId: hook.Id, Event: event.Event, Payload: payload})
+	}
+}
+
+func QueueDelivery(delivery *Delivery) {
+	select {
+	case webhookDeliveries <- delivery:
+	default:
+		log.Printf("Too many pending webhook deliveries, dropping %s to webhook %d", delivery.Event, delivery.WebhookId)
+	}
+}
+
+// Pending deliveries of a single webhook
+const webhookQueueSize = 64
+
+// A webhook goroutine that has nothing to deliver for this long is stopped
+const webhookQueueIdle = 10 * time.Minute
+
+// Delivers queued events until quit is closed. Each webhook gets its events in
+// order from its own goroutine, so a slow receiver only holds back itself.
+func SendWebhookEvents(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	var senders sync.WaitGroup
+	defer senders.Wait()
+	queues := make(map[int]chan *Delivery)
+	idle := make(chan int)
+	for {
+		select {
+		case delivery := <-webhookDeliveries:
+			queue, ok := queues[delivery.WebhookId]
+			if !ok {
+				queue = make(chan *Delivery, webhookQueueSize)
+				queues[delivery.WebhookId] = queue
+				senders.Add(1)
+				go sendWebhookQueue(delivery.WebhookId, queue, idle, &senders, quit)
+			}
+			select {
+			case queue <- delivery:
+			default:
+				log.Printf("Too many pending deliveries to webhook %d, dropping %s", delivery.WebhookId, delivery.Event)
+			}
+		case id := <-idle:
+			// Deliveries queued since the goroutine asked are sent first
+			if queue, ok := queues[id]; ok && len(queue) == 0 {
+				delete(queues, id)
+				close(queue)
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Delivers the events of webhook id until quit is closed, or until its queue
+// is closed. It asks for that on idle once the webhook is deleted, or after
+// webhookQueueIdle without deliveries.
+func sendWebhookQueue(id int, queue <-chan *Delivery, idle chan<- int, wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	for {
+		select {
+		case delivery, ok := <-queue:
+			if !ok {
+				return
+			}
+			if deliver(delivery) {
+				continue
+			}
+		case <-time.After(webhookQueueIdle):
+		case <-quit:
+			return
+		}
+		select {
+		case idle <- id:
+		case <-quit:
+			return
+		}
+	}
+}
+
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Posts the delivery and records the result on the delivery log. Returns
+// false if the webhook was deleted.
+func deliver(delivery *Delivery) bool {
+	hook := FindWebhook(delivery.WebhookId)
+	if hook == nil {
+		return false // deleted while the delivery was queued
+	}
+	// The id is sent on a header
+	SaveDelivery(delivery)
+	defer SaveDelivery(delivery)
+
+	delivery.DeliveredAt = time.Now()
+	defer func() { delivery.Duration = time.Since(delivery.DeliveredAt) }()
+
+	req, err := http.NewRequest("POST", hook.Url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		delivery.Error = err.Error()
+		return true
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "sea")
+	req.Header.Set("X-Sea-Event", delivery.Event)
+	req.Header.Set("X-Sea-Delivery", strconv.Itoa(delivery.Id))
+	if hook.Secret != "" {
+		req.Header.Set("X-Sea-Signature-256", signPayload(hook.Secret, delivery.Payload))
+	}
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		delivery.Error = err.Error()
+		log.Printf("Webhook %d: %v", hook.Id, err)
+		return true
+	}
+	defer res.Body.Close()
+	delivery.StatusCode = res.StatusCode
+	response, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxDeliveryResponse))
+	delivery.Response = string(response)
+	if !delivery.Success() {
+		log.Printf("Webhook %d: %s answered %s", hook.Id, hook.Url, res.Status)
+	}
+	return true
+}
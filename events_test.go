@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookQueueStopsOnDelete(t *testing.T) {
+	teardown := setupTestDB(t)
+	defer teardown()
+	posted := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted <- r.Header.Get("X-Sea-Event")
+	}))
+	defer server.Close()
+	hook := &Webhook{Url: server.URL}
+	SaveWebhook(hook)
+
+	var wg sync.WaitGroup
+	queue := make(chan *Delivery, webhookQueueSize)
+	idle := make(chan int)
+	quit := make(chan struct{})
+	defer close(quit)
+	wg.Add(1)
+	go sendWebhookQueue(hook.Id, queue, idle, &wg, quit)
+
+	queue <- &Delivery{WebhookId: hook.Id, Event: EventBuildQueued, Payload: []byte("{}")}
+	select {
+	case event := <-posted:
+		if event != EventBuildQueued {
+			t.Errorf("delivered %q, want %q", event, EventBuildQueued)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery never posted")
+	}
+	select {
+	case id := <-idle:
+		t.Fatalf("webhook %d asked to stop right after a delivery", id)
+	default:
+	}
+
+	DeleteWebhook(hook.Id)
+	queue <- &Delivery{WebhookId: hook.Id, Event: EventBuildQueued, Payload: []byte("{}")}
+	select {
+	case id := <-idle:
+		if id != hook.Id {
+			t.Errorf("asked to stop webhook %d, want %d", id, hook.Id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deleted webhook never asked to stop")
+	}
+	close(queue)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing the queue did not stop its goroutine")
+	}
+}
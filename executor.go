@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Starts the processes of builds. Implementations decide how much of the
+// host they can see, the build directory is always writable.
+type Executor interface {
+	// Returns the command that runs argv on directory with env, and a
+	// function to release anything it allocated once the command finished.
+	Command(directory string, argv []string, env []string) (*exec.Cmd, func(), error)
+}
+
+var executorNames = [...]string{"local", "sandbox", "container"}
+
+func validExecutor(name string) bool {
+	for _, n := range executorNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Name of the executor used by the repository builds
+func (r *Repository) ExecutorName() string {
+	if r.Executor != "" {
+		return r.Executor
+	}
+	return Config.Executor
+}
+
+func NewExecutor(r *Repository) (Executor, error) {
+	switch name := r.ExecutorName(); name {
+	case "local":
+		return localExecutor{}, nil
+	case "sandbox":
+		return sandboxExecutor{network: !r.DisableNetwork}, nil
+	case "container":
+		image := r.Image
+		if image == "" {
+			image = Config.ContainerImage
+		}
+		if image == "" {
+			return nil, fmt.Errorf("no container image set for %q", r.Name)
+		}
+		return containerExecutor{
+			runtime: Config.ContainerRuntime,
+			image:   image,
+			network: !r.DisableNetwork,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown executor %q", name)
+	}
+}
+
+// Runs builds as the sea user, with access to everything it has
+type localExecutor struct{}
+
+func (localExecutor) Command(directory string, argv []string, env []string) (*exec.Cmd, func(), error) {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = directory
+	cmd.Env = env
+	return cmd, func() {}, nil
+}
+
+// Runs builds with bubblewrap. The host filesystem is mounted read-only,
+// with the directories of sea and the user home hidden behind empty ones.
+type sandboxExecutor struct {
+	network bool
+}
+
+func (e sandboxExecutor) Command(directory string, argv []string, env []string) (*exec.Cmd, func(), error) {
+	directory, err := filepath.Abs(directory)
+	if err != nil {
+		return nil, nil, err
+	}
+	args := []string{
+		"--ro-bind", "/", "/",
+		"--dev", "/dev",
+		"--proc", "/proc",
+		"--tmpfs", "/tmp",
+	}
+	for _, path := range hiddenPaths() {
+		args = append(args, "--tmpfs", path)
+	}
+	// Mounted after the tmpfs ones, as it's usually below one of them
+	args = append(args, "--bind", directory, directory)
+	if !e.network {
+		args = append(args, "--unshare-net")
+	}
+	args = append(args,
+		"--unshare-pid",
+		"--unshare-ipc",
+		"--die-with-parent",
+		"--chdir", directory,
+		"--",
+	)
+	cmd := exec.Command("bwrap", append(args, argv...)...)
+	cmd.Dir = directory
+	cmd.Env = env
+	return cmd, func() {}, nil
+}
+
+// Directories a sandboxed build must not read: the database, clones of every
+// repository, artifacts, caches and the credentials of the sea user
+func hiddenPaths() []string {
+	var paths []string
+	database := ""
+	if Config.DBPath != "" {
+		database = filepath.Dir(Config.DBPath)
+	}
+	for _, path := range [...]string{
+		database,
+		Config.ReposPath,
+		Config.ArtifactsPath,
+		Config.CachePath,
+		os.Getenv("HOME"),
+	} {
+		if path == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(path); err == nil && abs != "/" {
+			paths = append(paths, abs)
+		}
+	}
+	return paths
+}
+
+var containerSeq uint64
+
+// Runs builds on a container of image through a docker compatible CLI. Only
+// the build directory is mounted, at the same path it has on the host.
+type containerExecutor struct {
+	runtime string
+	image   string
+	network bool
+}
+
+func (e containerExecutor) Command(directory string, argv []string, env []string) (*exec.Cmd, func(), error) {
+	directory, err := filepath.Abs(directory)
+	if err != nil {
+		return nil, nil, err
+	}
+	name := fmt.Sprintf("sea-%s-%d", filepath.Base(directory), atomic.AddUint64(&containerSeq, 1))
+	args := []string{
+		"run", "--rm", "--init",
+		"--name", name,
+		// Files created by the build must be readable to collect artifacts
+		// and removable when it finishes
+		"--user", strconv.Itoa(os.Getuid()) + ":" + strconv.Itoa(os.Getgid()),
+		"--volume", directory + ":" + directory,
+		"--workdir", directory,
+	}
+	if !e.network {
+		args = append(args, "--network", "none")
+	}
+	// Values are passed on a file only sea can read, as the command line is
+	// visible to every user of the host. The build env never reaches the CLI
+	// itself, it would let a commit set DOCKER_HOST, DOCKER_CONFIG or PATH.
+	envFile, err := writeEnvFile(env)
+	if err != nil {
+		return nil, nil, err
+	}
+	args = append(args, "--env-file", envFile, e.image)
+
+	cmd := exec.Command(e.runtime, append(args, argv...)...)
+	cmd.Dir = directory
+	cmd.Env = os.Environ()
+	// Stopping the CLI doesn't always stop the container
+	cleanup := func() {
+		exec.Command(e.runtime, "rm", "--force", name).Run()
+		os.Remove(envFile)
+	}
+	return cmd, cleanup, nil
+}
+
+// Writes the variables a container gets from env to a new 0600 file outside
+// of the build directory, returning its path
+func writeEnvFile(env []string) (string, error) {
+	var buffer bytes.Buffer
+	for _, entry := range env {
+		key := entry[:strings.IndexByte(entry, '=')]
+		if isBaseEnv(key) {
+			continue
+		}
+		if strings.ContainsAny(entry, "\r\n") {
+			return "", fmt.Errorf("the container executor can't pass %s, its value has a line break", key)
+		}
+		buffer.WriteString(entry + "\n")
+	}
+	file, err := ioutil.TempFile("", "sea-env-")
+	if err != nil {
+		return "", err
+	}
+	// TempFile creates it with 0600
+	_, err = file.Write(buffer.Bytes())
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// The host PATH and HOME make no sense inside a container
+func isBaseEnv(key string) bool {
+	for _, k := range baseEnv {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
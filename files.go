@@ -0,0 +1,231 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Resolves the symlinks of path, failing unless the result is still under
+// root, so a committed link can't expose files from elsewhere on the host.
+// Missing components at the end of path are kept as they are.
+func resolveInside(root, path string) (string, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) && filepath.Clean(path) != filepath.Clean(root) {
+		parent, err := resolveInside(root, filepath.Dir(path))
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(parent, filepath.Base(path)), nil
+	} else if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(realRoot, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q is outside of %q", path, root)
+	}
+	return resolved, nil
+}
+
+// Reads a file of a build, failing if it was replaced by a symlink since it
+// was checked
+func readFileNoFollow(path string) ([]byte, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	// The walk checked it's a regular file, it must not have been replaced
+	in, err := os.OpenFile(src, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err = os.MkdirAll(filepath.Dir(dst), 0775); err != nil {
+		return err
+	}
+	// dst may be in a build directory, where a symlink could have been left
+	// in its place
+	if err = os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Copies the file or directory at src to dst. Symlinks are skipped at every
+// level, they could point anywhere outside of src, and replaced where found
+// in dst. Calls fn, if not nil, with the path relative to src and the size of
+// each copied file.
+func copyTree(src, dst string, fn func(path string, size int64)) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return makeDir(target)
+		case info.Mode().IsRegular():
+			if err = copyFile(path, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			if fn != nil {
+				fn(rel, info.Size())
+			}
+		}
+		return nil
+	})
+}
+
+// Creates the directory at path, whose parent must exist, replacing anything
+// else found there without following it
+func makeDir(path string) error {
+	info, err := os.Lstat(path)
+	if err == nil && info.IsDir() {
+		return nil
+	}
+	if err == nil {
+		err = os.Remove(path)
+	} else if os.IsNotExist(err) {
+		err = os.MkdirAll(filepath.Dir(path), 0775)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(path, 0775)
+}
+
+// Total size of the regular files under path
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// Writes the files, directories and symlinks under root as a tar stream
+func writeTar(w io.Writer, root string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Extracts a tar stream written by writeTar into root. Symlinks are skipped
+// unless the stream comes from a trusted source, as a file written after one
+// of them could land anywhere.
+func extractTar(r io.Reader, root string, symlinks bool) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("tar entry %q is outside of the directory", header.Name)
+		}
+		target := filepath.Join(root, name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0775)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(tr, target, os.FileMode(header.Mode).Perm())
+		case tar.TypeSymlink:
+			if symlinks {
+				if err = os.MkdirAll(filepath.Dir(target), 0775); err == nil {
+					err = os.Symlink(header.Linkname, target)
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractFile(r io.Reader, target string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0775); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"regexp"
 	"sync"
 	"syscall"
 )
@@ -98,3 +99,51 @@ func readPipe(f *os.File) (<-chan string, <-chan error) {
 	}()
 	return results, errors
 }
+
+// Git sends this as the old or new revision when a ref is created or deleted
+const nullRev = "0000000000000000000000000000000000000000"
+
+var revRegexp = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// Whether rev is a full SHA-1 revision, as sent by webhooks
+func validRev(rev string) bool {
+	return revRegexp.MatchString(rev)
+}
+
+// First 10 characters of the revision, for messages
+func shortRev(rev string) string {
+	if len(rev) > 10 {
+		return rev[:10]
+	}
+	return rev
+}
+
+func StartLocalBuild(hook GitHook) error {
+	repo, err := FindRepositoryByPath(hook.RepoPath)
+	if err != nil {
+		return err
+	}
+	if repo == nil {
+		return fmt.Errorf("no repository registered at %q", hook.RepoPath)
+	}
+
+	if hook.NewRev == nullRev {
+		log.Printf("Ref %s deleted from %q, nothing to build", hook.RefName, repo.Name)
+		return nil
+	}
+
+	// Tag pushes send the id of the annotated tag object, not the commit
+	rev, err := repo.ResolveRev(hook.NewRev)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Queueing %s (%s) of %q", rev, hook.RefName, repo.Name)
+	EnqueueBuild(repo, &Build{
+		Rev:     rev,
+		OldRev:  hook.OldRev,
+		Ref:     hook.RefName,
+		Trigger: TriggerPipeHook,
+	})
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where and when to notify about finished builds of a repository
+type NotificationRule struct {
+	Channel string `json:"channel"` // email, slack or webhook
+	Target  string `json:"target"`  // addresses separated by commas for email, an url otherwise
+	When    string `json:"when"`    // always, failure or change
+}
+
+var (
+	notificationChannels = [...]string{"email", "slack", "webhook"}
+	notificationWhens    = [...]string{"always", "failure", "change"}
+)
+
+func (rule NotificationRule) Validate() error {
+	if !containsString(notificationChannels[:], rule.Channel) {
+		return fmt.Errorf("unknown notification channel %q", rule.Channel)
+	}
+	if !containsString(notificationWhens[:], rule.When) {
+		return fmt.Errorf("unknown notification condition %q", rule.When)
+	}
+	if rule.Target == "" {
+		return fmt.Errorf("missing %s notification target", rule.Channel)
+	}
+	if rule.Channel != "email" && !strings.HasPrefix(rule.Target, "http://") && !strings.HasPrefix(rule.Target, "https://") {
+		return fmt.Errorf("invalid %s url %q", rule.Channel, rule.Target)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// How the state of a build compares to the previous one of the same ref
+type Transition string
+
+const (
+	TransitionNone   Transition = ""
+	TransitionBroken Transition = "broken" // failed after a success, or at first
+	TransitionFixed  Transition = "fixed"  // succeeded after a failure
+)
+
+func buildTransition(build, previous *Build) Transition {
+	passed := build.State == BuildSuccess
+	passedBefore := previous == nil || previous.State == BuildSuccess
+	switch {
+	case passed && !passedBefore:
+		return TransitionFixed
+	case !passed && passedBefore:
+		return TransitionBroken
+	default:
+		return TransitionNone
+	}
+}
+
+func (rule NotificationRule) Matches(build *Build, transition Transition) bool {
+	switch rule.When {
+	case "always":
+		return true
+	case "failure":
+		return build.State != BuildSuccess
+	case "change":
+		return transition != TransitionNone
+	default:
+		return false
+	}
+}
+
+// A finished build as sent to notification channels. Also the body of
+// generic webhook notifications.
+type Notification struct {
+	Repository string     `json:"repository"`
+	Number     int        `json:"number"`
+	State      string     `json:"state"`
+	Transition Transition `json:"transition,omitempty"`
+	Ref        string     `json:"ref,omitempty"`
+	Rev        string     `json:"rev"`
+	Author     string     `json:"author,omitempty"`
+	Subject    string     `json:"subject,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Url        string     `json:"url"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt time.Time  `json:"finished_at"`
+}
+
+func newNotification(repo *Repository, build *Build, transition Transition) Notification {
+	return Notification{
+		Repository: repo.Name,
+		Number:     build.Number,
+		State:      build.State.String(),
+		Transition: transition,
+		Ref:        build.RefName(),
+		Rev:        build.Rev,
+		Author:     build.Author,
+		Subject:    build.Subject(),
+		Error:      build.Error,
+		Url:        Config.BaseUrl + build.Url(),
+		StartedAt:  build.StartedAt,
+		FinishedAt: build.FinishedAt,
+	}
+}
+
+// One line summary, like "sea #12 (master): Failed, broken"
+func (n Notification) Title() string {
+	title := fmt.Sprintf("%s #%d", n.Repository, n.Number)
+	if n.Ref != "" {
+		title += fmt.Sprintf(" (%s)", n.Ref)
+	}
+	title += ": " + n.State
+	if n.Transition != TransitionNone {
+		title += ", " + string(n.Transition)
+	}
+	return title
+}
+
+func (n Notification) Text() string {
+	lines := []string{n.Title(), n.Url, ""}
+	if n.Subject != "" {
+		lines = append(lines, fmt.Sprintf("%s %s", shortRev(n.Rev), n.Subject))
+	}
+	if n.Author != "" {
+		lines = append(lines, "Author: "+n.Author)
+	}
+	if n.Error != "" {
+		lines = append(lines, "Error: "+n.Error)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Delivers notifications to one kind of target
+type Notifier interface {
+	Notify(target string, n Notification) error
+}
+
+var notifiers = map[string]Notifier{
+	"email":   emailNotifier{},
+	"slack":   slackNotifier{},
+	"webhook": webhookNotifier{},
+}
+
+type emailNotifier struct{}
+
+// Notifier
+func (emailNotifier) Notify(target string, n Notification) error {
+	if Config.SmtpAddr == "" {
+		return fmt.Errorf("no SMTP server configured, start sea with -smtp-addr")
+	}
+	var to []string
+	for _, address := range strings.Split(target, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			to = append(to, address)
+		}
+	}
+	var auth smtp.Auth
+	if Config.SmtpUser != "" {
+		host := strings.SplitN(Config.SmtpAddr, ":", 2)[0]
+		auth = smtp.PlainAuth("", Config.SmtpUser, Config.SmtpPassword, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", Config.SmtpFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: [sea] %s\r\n", n.Title())
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(n.Text(), "\n", "\r\n", -1))
+	return smtp.SendMail(Config.SmtpAddr, auth, Config.SmtpFrom, to, msg.Bytes())
+}
+
+var notificationClient = &http.Client{Timeout: 30 * time.Second}
+
+func postNotificationJSON(url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	res, err := notificationClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: %s", url, res.Status)
+	}
+	return nil
+}
+
+// Incoming webhooks of Slack and Mattermost
+type slackNotifier struct{}
+
+// Notifier
+func (slackNotifier) Notify(target string, n Notification) error {
+	text := fmt.Sprintf("<%s|%s>", n.Url, n.Title())
+	if n.Subject != "" {
+		text += fmt.Sprintf("\n`%s` %s", shortRev(n.Rev), n.Subject)
+	}
+	if n.Error != "" {
+		text += "\n" + n.Error
+	}
+	return postNotificationJSON(target, map[string]string{"text": text})
+}
+
+// POSTs the Notification as JSON
+type webhookNotifier struct{}
+
+// Notifier
+func (webhookNotifier) Notify(target string, n Notification) error {
+	return postNotificationJSON(target, n)
+}
+
+// Delivery attempts of a notification, waiting twice as long after each
+// failure, starting at notificationBackoff
+const (
+	notificationAttempts = 5
+	notificationBackoff  = 10 * time.Second
+)
+
+type notificationDelivery struct {
+	rule         NotificationRule
+	notification Notification
+}
+
+var notificationDeliveries = make(chan notificationDelivery, 256)
+
+// Queues notifications of the finished build for the repository rules it
+// matches. Only top-level builds are notified, matrix builds once all of
+// their jobs finished.
+func QueueNotifications(build *Build) {
+	if build.ParentId != 0 || build.State == BuildQueued || build.State == BuildRunning {
+		return
+	}
+	repo := FindRepository(build.RepositoryId)
+	if repo == nil || len(repo.Notifications) == 0 {
+		return
+	}
+	transition := buildTransition(build, PreviousBuild(build))
+	notification := newNotification(repo, build, transition)
+	for _, rule := range repo.Notifications {
+		if !rule.Matches(build, transition) {
+			continue
+		}
+		select {
+		case notificationDeliveries <- notificationDelivery{rule, notification}:
+		default:
+			log.Printf("Build %d: too many pending notifications, dropping %s to %s", build.Id, rule.Channel, rule.Target)
+		}
+	}
+}
+
+// Delivers queued notifications until quit is closed
+func SendNotifications(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	for {
+		select {
+		case delivery := <-notificationDeliveries:
+			wg.Add(1)
+			go deliverNotification(delivery, wg, quit)
+		case <-quit:
+			return
+		}
+	}
+}
+
+func deliverNotification(delivery notificationDelivery, wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	rule := delivery.rule
+	backoff := notificationBackoff
+	for attempt := 1; ; attempt++ {
+		err := notifiers[rule.Channel].Notify(rule.Target, delivery.notification)
+		if err == nil {
+			return
+		}
+		log.Printf("Notification %q to %s (attempt %d/%d): %v",
+			delivery.notification.Title(), rule.Target, attempt, notificationAttempts, err)
+		if attempt == notificationAttempts {
+			return
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Closed and replaced to wake up every idle worker when the queue changes, as
+// only some of them may take a build with the labels of its repository.
+var (
+	queueMutex   sync.Mutex
+	queueChanged = make(chan struct{})
+)
+
+func notifyWorkers() {
+	queueMutex.Lock()
+	close(queueChanged)
+	queueChanged = make(chan struct{})
+	queueMutex.Unlock()
+}
+
+// Must be called before looking at the queue, so that no change is missed
+func queueNotification() <-chan struct{} {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	return queueChanged
+}
+
+// Pops the oldest queued build the runner accepts, already marked as running
+// on it
+func popBuildFor(runner *Runner) *Build {
+	if QueueEmpty() {
+		return nil
+	}
+	repos := repositoriesById()
+	return PopQueuedBuild(runner.Name, func(build *Build) bool {
+		return runner.Accepts(repos, build)
+	})
+}
+
+// Queues a new build of the repository. The build must have at least Rev and
+// Trigger set, a new Id is generated for it.
+func EnqueueBuild(repo *Repository, build *Build) *Build {
+	build.Id = 0
+	build.RepositoryId = repo.Id
+	build.State = BuildQueued
+	build.QueuedAt = time.Now()
+	QueueBuild(build)
+	notifyWorkers()
+	EmitBuildEvent(EventBuildQueued, build)
+	return build
+}
+
+// Starts a worker for each local runner, already registered, running the
+// queued builds they accept in FIFO order until quit is closed.
+func StartWorkers(runners []*Runner, wg *sync.WaitGroup, quit <-chan struct{}) {
+	log.Printf("Starting %d build workers", len(runners))
+	wg.Add(len(runners))
+	for _, runner := range runners {
+		go worker(runner, wg, quit)
+	}
+}
+
+func worker(runner *Runner, wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer wg.Done()
+	for {
+		changed := queueNotification()
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		build := popBuildFor(runner)
+		if build == nil {
+			select {
+			case <-changed:
+				continue
+			case <-quit:
+				return
+			}
+		}
+
+		finishBuild(build, runQueuedBuild(build))
+	}
+}
+
+// Records the error that prevented the build from running, if any, once an
+// agent is done with it, and reports the final state to the commit status
+// provider, notification channels and webhooks.
+func finishBuild(build *Build, err error) {
+	if err != nil {
+		log.Printf("Build #%d failed to run: %v", build.Id, err)
+		build.State = BuildFailed
+		build.Error = err.Error()
+		build.FinishedAt = time.Now()
+		SaveBuild(build)
+	}
+	if build.State == BuildRunning {
+		// Expanded into a matrix build, its jobs finish it
+		QueueCommitStatus(build)
+		return
+	}
+	buildFinished(build)
+}
+
+func buildFinished(build *Build) {
+	QueueCommitStatus(build)
+	QueueNotifications(build)
+	EmitBuildEvent(EventBuildFinished, build)
+	if build.ParentId != 0 {
+		if parent := UpdateParentBuild(build.ParentId); parent != nil {
+			buildFinished(parent)
+		}
+	}
+}
+
+// Turns the build into a matrix build, queueing one job for each environment.
+func EnqueueJobs(parent *Build, envs []map[string]string) {
+	now := time.Now()
+	parent.State = BuildRunning
+	parent.StartedAt = now
+	parent.Jobs = len(envs)
+
+	jobs := make([]*Build, len(envs))
+	for i, env := range envs {
+		jobs[i] = &Build{
+			RepositoryId: parent.RepositoryId,
+			Number:       parent.Number,
+			ParentId:     parent.Id,
+			Job:          i + 1,
+			Env:          env,
+			Rev:          parent.Rev,
+			OldRev:       parent.OldRev,
+			Ref:          parent.Ref,
+			Trigger:      parent.Trigger,
+			Author:       parent.Author,
+			Message:      parent.Message,
+			State:        BuildQueued,
+			QueuedAt:     now,
+		}
+	}
+	QueueJobs(parent, jobs)
+	notifyWorkers()
+	for _, job := range jobs {
+		EmitBuildEvent(EventBuildQueued, job)
+	}
+}
+
+// Cancels a running or queued build, or all jobs of a matrix build. Returns
+// false if there was nothing to cancel.
+func CancelBuild(build *Build) bool {
+	if build.Jobs > 0 {
+		canceled := false
+		for _, job := range BuildJobs(build) {
+			if CancelBuild(job) {
+				canceled = true
+			}
+		}
+		return canceled
+	}
+	if running, ok := RunningBuilds.Get(build.Id); ok {
+		running.Cancel()
+		return true
+	}
+	if CancelQueuedBuild(build) {
+		buildFinished(build)
+		return true
+	}
+	return false
+}
+
+// Prepares the build and runs it on the worker
+func runQueuedBuild(build *Build) error {
+	// Cancelable while it's being prepared
+	running := NewRunningBuild(build)
+	RunningBuilds.Add(running)
+	defer RunningBuilds.Remove(build.Id)
+
+	job, err := prepareQueuedBuild(build)
+	if job == nil {
+		return err
+	}
+	defer os.RemoveAll(job.Build.Path)
+	return runJob(running, job, localAgent{})
+}
+
+func prepareQueuedBuild(build *Build) (*BuildJob, error) {
+	repo := FindRepository(build.RepositoryId)
+	if repo == nil {
+		return nil, fmt.Errorf("repository %d not found", build.RepositoryId)
+	}
+	return repo.PrepareBuild(build)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Remote agents post their output at least this often. A build whose agent
+// stays silent for longer is given up.
+const agentTimeout = time.Minute
+
+// How long a claim waits for a queued build before answering 204
+const claimWait = 30 * time.Second
+
+// Sent by an agent once the build finished
+type agentReport struct {
+	State      BuildState
+	ReturnCode int
+	Error      string
+	Steps      []StepResult
+	Artifacts  []Artifact
+	Tests      []TestResult
+
+	// Why the build could not run at all, like a missing Seafile
+	Failure string
+}
+
+// Server side of a build claimed by a remote agent
+type remoteAgent struct {
+	name     string
+	build    RunningBuild
+	finished chan agentReport
+
+	sync.Mutex
+	seen time.Time
+}
+
+func newRemoteAgent(name string, build RunningBuild) *remoteAgent {
+	return &remoteAgent{
+		name:     name,
+		build:    build,
+		finished: make(chan agentReport, 1),
+		seen:     time.Now(),
+	}
+}
+
+func (a *remoteAgent) touch() {
+	a.Lock()
+	a.seen = time.Now()
+	a.Unlock()
+}
+
+func (a *remoteAgent) idle() time.Duration {
+	a.Lock()
+	defer a.Unlock()
+	return time.Since(a.seen)
+}
+
+// Agent
+func (a *remoteAgent) Run(job *BuildJob, build RunningBuild) error {
+	ticker := time.NewTicker(agentTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case report := <-a.finished:
+			if report.Failure != "" {
+				return errors.New(report.Failure)
+			}
+			build.State = report.State
+			build.ReturnCode = report.ReturnCode
+			build.Error = report.Error
+			build.Steps = report.Steps
+			build.Artifacts = report.Artifacts
+			build.Tests = report.Tests
+			return nil
+		case <-build.abort:
+			// Shutdown or a second cancel don't wait for the agent, it's
+			// told to stop on its next output post
+			build.State = BuildCanceled
+			return nil
+		case <-ticker.C:
+			if a.idle() > agentTimeout {
+				return fmt.Errorf("agent %q stopped responding", a.name)
+			}
+		}
+	}
+}
+
+type remoteList struct {
+	sync.RWMutex
+
+	// Builds claimed by remote agents indexed by build id
+	m map[int]*remoteAgent
+}
+
+var RemoteAgents = remoteList{m: make(map[int]*remoteAgent)}
+
+func (l *remoteList) Add(agent *remoteAgent) {
+	l.Lock()
+	l.m[agent.build.Id] = agent
+	l.Unlock()
+}
+
+func (l *remoteList) Remove(id int) {
+	l.Lock()
+	delete(l.m, id)
+	l.Unlock()
+}
+
+func (l *remoteList) Get(id int) (*remoteAgent, bool) {
+	l.RLock()
+	agent, ok := l.m[id]
+	l.RUnlock()
+	return agent, ok
+}
+
+// Guards the agent API with Config.AgentToken, sent by agents as a bearer
+// token. The API is disabled without one.
+func agentHandler(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if Config.AgentToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !validToken(Config.AgentToken, token) {
+			http.Error(w, "Invalid agent token", http.StatusUnauthorized)
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+func findAgentParam(w http.ResponseWriter, r *http.Request, ps httprouter.Params) *remoteAgent {
+	id, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		http.Error(w, "Invalid `id` parameter", http.StatusBadRequest)
+		return nil
+	}
+	agent, ok := RemoteAgents.Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return nil
+	}
+	agent.touch()
+	Runners.Touch(agent.name)
+	return agent
+}
+
+// Hands the oldest queued build the agent accepts, waiting up to claimWait for
+// one, or until the agent hangs up. The agent downloads the checked out files
+// next. Claiming also keeps the agent listed as an online runner. Claimed
+// builds are counted on wg until they finish, so shutdown waits for them.
+func claimAgentsHandler(wg *sync.WaitGroup) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		claimBuild(w, r, wg)
+	}
+}
+
+func claimBuild(w http.ResponseWriter, r *http.Request, wg *sync.WaitGroup) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		name = "remote"
+	}
+	labels, err := parseLabels(r.FormValue("labels"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	runner := &Runner{Name: name, Labels: labels, Remote: true}
+	if err = Runners.Register(runner); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	closed := w.(http.CloseNotifier).CloseNotify()
+	deadline := time.After(claimWait)
+	for {
+		changed := queueNotification()
+		select {
+		case <-closed:
+			return
+		default:
+		}
+		build := popBuildFor(runner)
+		if build == nil {
+			select {
+			case <-changed:
+				continue
+			case <-closed:
+				return
+			case <-deadline:
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		running := NewRunningBuild(build)
+		if !RunningBuilds.Start(running, wg) {
+			requeueClaimed(build)
+			http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		job, err := prepareQueuedBuild(build)
+		if job == nil {
+			RunningBuilds.Remove(build.Id)
+			finishBuild(build, err)
+			wg.Done()
+			continue
+		}
+
+		// Webhook secrets are of no use to agents
+		repo := *job.Repository
+		repo.WebhookSecret = ""
+		sent := *job
+		sent.Repository = &repo
+		body, err := json.Marshal(&sent)
+		if err != nil {
+			requeueClaimed(build)
+			wg.Done()
+			panic(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+		w.(http.Flusher).Flush()
+		// Nobody else would run the build if the agent never got it
+		select {
+		case <-closed:
+			log.Printf("Agent %q hung up claiming build #%d", name, build.Id)
+			requeueClaimed(build)
+			wg.Done()
+			return
+		default:
+		}
+		log.Printf("Build #%d claimed by agent %q", build.Id, name)
+
+		agent := newRemoteAgent(name, running)
+		RemoteAgents.Add(agent)
+		go func() {
+			defer wg.Done()
+			defer os.RemoveAll(build.Path)
+			defer RemoteAgents.Remove(build.Id)
+			defer RunningBuilds.Remove(build.Id)
+			finishBuild(build, runJob(agent.build, job, agent))
+		}()
+		return
+	}
+}
+
+// Puts a build popped by a claim that could not be handed to the agent back
+// on the queue
+func requeueClaimed(build *Build) {
+	RunningBuilds.Remove(build.Id)
+	os.RemoveAll(build.Path)
+	build.Path = ""
+	build.State = BuildQueued
+	build.StartedAt = time.Time{}
+	build.Agent = ""
+	QueueBuild(build)
+	notifyWorkers()
+}
+
+func sourceAgentsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	agent := findAgentParam(w, r, ps)
+	if agent == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	if err := writeTar(w, agent.build.Path); err != nil {
+		panic(err)
+	}
+	agent.touch()
+}
+
+// Appends the request body to the build output. Answers whether the build
+// was canceled or aborted, so the agent can stop it.
+func outputAgentsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	agent := findAgentParam(w, r, ps)
+	if agent == nil {
+		return
+	}
+	if _, err := io.Copy(agent.build.Buffer, r.Body); err != nil {
+		log.Print(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var response struct{ Cancel, Abort bool }
+	select {
+	case <-agent.build.cancel:
+		response.Cancel = true
+	default:
+	}
+	select {
+	case <-agent.build.abort:
+		response.Abort = true
+	default:
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&response)
+}
+
+func artifactsAgentsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	agent := findAgentParam(w, r, ps)
+	if agent == nil {
+		return
+	}
+	if err := extractTar(r.Body, artifactsDir(agent.build.Build), false); err != nil {
+		log.Print(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func finishAgentsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	agent := findAgentParam(w, r, ps)
+	if agent == nil {
+		return
+	}
+	var report agentReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	select {
+	case agent.finished <- report:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Build already finished", http.StatusConflict)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const testAgentToken = "agent-token"
+
+// Runs the agent API on a scratch database
+func setupAgentServer(t *testing.T) (*httptest.Server, func()) {
+	teardownDB := setupTestDB(t)
+	Config.AgentToken = testAgentToken
+
+	var builds sync.WaitGroup
+	router := httprouter.New()
+	router.POST("/agent/claim", agentHandler(claimAgentsHandler(&builds)))
+	router.GET("/agent/builds/:id/source", agentHandler(sourceAgentsHandler))
+	router.POST("/agent/builds/:id/output", agentHandler(outputAgentsHandler))
+	router.PUT("/agent/builds/:id/artifacts", agentHandler(artifactsAgentsHandler))
+	router.POST("/agent/builds/:id/finish", agentHandler(finishAgentsHandler))
+	server := httptest.NewServer(&HTTPWrapper{router})
+
+	return server, func() {
+		RunningBuilds.CancelAll()
+		builds.Wait()
+		server.Close()
+		teardownDB()
+	}
+}
+
+// Commits the files to the repository, returning the new revision
+func commitFiles(t *testing.T, repo *Repository, files map[string]string) string {
+	work, err := ioutil.TempDir("", "sea_work_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(work)
+	for name, content := range files {
+		if err = ioutil.WriteFile(filepath.Join(work, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	remote, err := filepath.Abs(repo.LocalPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = work
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=Test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=Test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "Test build")
+	git("push", "-q", remote, "HEAD:refs/heads/master")
+	return git("rev-parse", "HEAD")
+}
+
+func TestAgentRoundTrip(t *testing.T) {
+	server, teardown := setupAgentServer(t)
+	defer teardown()
+
+	repo := &Repository{Name: "agent-test"}
+	if err := StartRepository(repo); err != nil {
+		t.Fatal(err)
+	}
+	rev := commitFiles(t, repo, map[string]string{
+		"Seafile": "#!/bin/sh\necho \"hello from $SEA_REPO_NAME\"\n",
+	})
+	build := EnqueueBuild(repo, &Build{Rev: rev, Trigger: TriggerManual})
+
+	client := &agentClient{
+		server: server.URL,
+		token:  testAgentToken,
+		name:   "test-agent",
+		work:   "agent",
+		quit:   make(chan struct{}),
+	}
+	job, err := client.claim()
+	if err != nil {
+		t.Fatal("claim: ", err)
+	}
+	if job == nil || job.Build.Id != build.Id {
+		t.Fatalf("claimed %+v, want build #%d", job, build.Id)
+	}
+	if running := FindBuild(build.Id); running.State != BuildRunning || running.Agent != "test-agent" {
+		t.Fatalf("claimed build is %s on %q, want running on test-agent", running.State, running.Agent)
+	}
+	client.run(job)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		build = FindBuild(build.Id)
+		if build.State != BuildRunning || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if build.State != BuildSuccess {
+		t.Fatalf("build is %s (%s), want success\n%s", build.State, build.Error, build.Output)
+	}
+	if !strings.Contains(string(build.Output), "hello from agent-test") {
+		t.Errorf("output %q misses the Seafile output", build.Output)
+	}
+	if _, ok := RemoteAgents.Get(build.Id); ok {
+		t.Error("finished build still listed as claimed by the agent")
+	}
+}
+
+func TestAgentShutdown(t *testing.T) {
+	teardown := setupTestDB(t)
+	defer teardown()
+	Config.AgentToken = testAgentToken
+	var builds sync.WaitGroup
+	router := httprouter.New()
+	router.POST("/agent/claim", agentHandler(claimAgentsHandler(&builds)))
+	server := httptest.NewServer(&HTTPWrapper{router})
+	defer server.Close()
+
+	repo := &Repository{Name: "agent-test"}
+	if err := StartRepository(repo); err != nil {
+		t.Fatal(err)
+	}
+	rev := commitFiles(t, repo, map[string]string{"Seafile": "#!/bin/sh\nsleep 60\n"})
+	build := EnqueueBuild(repo, &Build{Rev: rev, Trigger: TriggerManual})
+
+	client := &agentClient{server: server.URL, token: testAgentToken, name: "test-agent"}
+	if job, err := client.claim(); err != nil || job == nil {
+		t.Fatalf("claim: %v, %v", job, err)
+	}
+	// The agent never reports back
+	RunningBuilds.CancelAll()
+	done := make(chan struct{})
+	go func() {
+		builds.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown kept waiting for the agent")
+	}
+	if build = FindBuild(build.Id); build.State != BuildCanceled {
+		t.Errorf("build is %s, want canceled", build.State)
+	}
+
+	EnqueueBuild(repo, &Build{Rev: rev, Trigger: TriggerManual})
+	if job, err := client.claim(); err == nil {
+		t.Errorf("claimed %+v after shutdown", job)
+	}
+}
+
+func TestAgentInvalidToken(t *testing.T) {
+	server, teardown := setupAgentServer(t)
+	defer teardown()
+
+	client := &agentClient{server: server.URL, token: "wrong", name: "test-agent"}
+	if _, err := client.claim(); err == nil {
+		t.Error("claim with an invalid token succeeded")
+	}
+}
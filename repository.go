@@ -1,14 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
-	"syscall"
+	"strings"
 	"time"
 
 	"github.com/libgit2/git2go"
@@ -19,12 +19,103 @@ type Repository struct {
 	Name   string
 	Remote bool
 	Url    string
+
+	// Used to verify incoming GitHub and Bitbucket hooks
+	WebhookSecret string
+
+	// Overrides Config.BuildTimeout when non-zero
+	BuildTimeout time.Duration
+
+	// Extra environment variables for builds
+	Env map[string]string
+
+	// How builds are run, Config.Executor when empty
+	Executor string
+	// Container image, Config.ContainerImage when empty
+	Image string
+	// Run isolated builds without network access
+	DisableNetwork bool
+
+	// Builds only run on runners offering all of them
+	Labels []string
+
+	// Commit statuses of remote repositories are posted to this provider,
+	// "github" or "bitbucket", none when empty
+	StatusProvider string
+	StatusRepo     string // owner/name on the provider, taken from Url when empty
+	StatusApiUrl   string // overrides the provider API url
+	StatusUser     string // Bitbucket user of the app password
+	StatusToken    []byte // encrypted API token or app password
+
+	Notifications []NotificationRule
 }
 
 func (r *Repository) LocalPath() string {
 	return path.Join(Config.ReposPath, fmt.Sprintf("%d.git", r.Id))
 }
 
+// Finds the registered repository whose local clone is at path. Both paths are
+// compared after resolving symlinks, as the post-receive hook sends `pwd -P`.
+func FindRepositoryByPath(path string) (*Repository, error) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, repo := range AllRepositories() {
+		local, err := filepath.Abs(repo.LocalPath())
+		if err != nil {
+			return nil, err
+		}
+		local, err = filepath.EvalSymlinks(local)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if local == target {
+			return repo, nil
+		}
+	}
+	return nil, nil
+}
+
+// Maximum duration of a build, zero means no limit
+func (r *Repository) Timeout() time.Duration {
+	if r.BuildTimeout != 0 {
+		return r.BuildTimeout
+	}
+	return Config.BuildTimeout
+}
+
+// Checks the settings shared by the web forms and the API, returning a
+// message for each problem
+func (r *Repository) Validate() []string {
+	var errs []string
+	if r.Name == "" {
+		errs = append(errs, "Name can't be blank")
+	}
+	if r.Remote && r.Url == "" {
+		errs = append(errs, "Url can't be blank for remote repositories")
+	}
+	if r.BuildTimeout < 0 {
+		errs = append(errs, fmt.Sprintf("Invalid build timeout %v", r.BuildTimeout))
+	}
+	if r.Executor != "" && !validExecutor(r.Executor) {
+		errs = append(errs, fmt.Sprintf("Unknown executor %q", r.Executor))
+	}
+	if r.ExecutorName() == "container" && r.Image == "" && Config.ContainerImage == "" {
+		errs = append(errs, "Image can't be blank for the container executor")
+	}
+	if r.StatusProvider != "" && !validStatusProvider(r.StatusProvider) {
+		errs = append(errs, fmt.Sprintf("Unknown status provider %q", r.StatusProvider))
+	}
+	if r.StatusProvider != "" && r.StatusSlug() == "" {
+		errs = append(errs, "Owner/name on the status provider can't be blank")
+	}
+	return errs
+}
+
 func StartRepository(r *Repository) (err error) {
 	SaveRepository(r)
 	if r.Remote {
@@ -41,46 +132,134 @@ func StartRepository(r *Repository) (err error) {
 	return
 }
 
-func (r *Repository) StartBuild(rev string) error {
+var ErrRepositoryNotFound = errors.New("repository not found")
+
+// Deletes the repository with its builds, secrets, caches, artifacts and
+// local clone. Its builds must not be running. Returns ErrRepositoryNotFound
+// if it was deleted already.
+func RemoveRepository(r *Repository) error {
+	builds, found := DeleteRepository(r.Id)
+	if !found {
+		return ErrRepositoryNotFound
+	}
+	for _, build := range builds {
+		if err := os.RemoveAll(artifactsDir(build)); err != nil {
+			return err
+		}
+	}
+	if err := ClearCache(r); err != nil {
+		return err
+	}
+	return os.RemoveAll(r.LocalPath())
+}
+
+// Resolves a branch, tag or revision to the full hash of the commit it
+// points to, peeling annotated tags.
+func (r *Repository) ResolveRev(spec string) (string, error) {
+	repo, err := git.OpenRepository(r.LocalPath())
+	if err != nil {
+		return "", err
+	}
+	object, err := repo.RevparseSingle(spec + "^{commit}")
+	if err != nil {
+		return "", err
+	}
+	defer object.Free()
+	return object.Id().String(), nil
+}
+
+// Resolves a branch or tag name, a full ref or a revision to the commit it
+// points to. Returns the full name of the ref when spec names one. Remote
+// repositories are fetched first, as their branches may be outdated.
+func (r *Repository) ResolveRef(spec string) (rev string, ref string, err error) {
+	repo, err := git.OpenRepository(r.LocalPath())
+	if err != nil {
+		return
+	}
+
+	var candidates []string
+	if r.Remote {
+		if err = fetchOrigin(repo); err != nil {
+			return
+		}
+		candidates = append(candidates, "refs/remotes/origin/"+spec)
+	}
+	candidates = append(candidates, "refs/heads/"+spec, "refs/tags/"+spec)
+	if strings.HasPrefix(spec, "refs/") {
+		candidates = append(candidates, spec)
+	}
+
+	for _, name := range candidates {
+		if _, e := repo.LookupReference(name); e != nil {
+			continue
+		}
+		if rev, err = r.ResolveRev(name); err != nil {
+			return
+		}
+		ref = name
+		// Branches of remotes are built as if they were local ones
+		if strings.HasPrefix(ref, "refs/remotes/origin/") {
+			ref = "refs/heads/" + strings.TrimPrefix(ref, "refs/remotes/origin/")
+		}
+		return
+	}
+
+	rev, err = r.ResolveRev(spec)
+	return
+}
+
+// Checks out the build revision on a new directory and loads its config. The
+// build must be already saved on the database, usually in the BuildQueued
+// state. Matrix builds are expanded into queued jobs instead, returning a nil
+// job. The caller must remove the job directory once it's done.
+func (r *Repository) PrepareBuild(b *Build) (*BuildJob, error) {
 	prefix := fmt.Sprintf("sea_%d_", r.Id)
 	directory, err := ioutil.TempDir("tmp", prefix)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	job, err := r.prepareBuild(b, directory)
+	if job == nil {
+		os.RemoveAll(directory)
+	}
+	return job, err
+}
+
+func (r *Repository) prepareBuild(b *Build, directory string) (*BuildJob, error) {
+	// Sandboxes and containers may not start on the sea working directory
+	directory, err := filepath.Abs(directory)
+	if err != nil {
+		return nil, err
 	}
-	defer os.RemoveAll(directory)
 	log.Printf("Temp build dir: %s", directory)
 
 	repo, err := git.OpenRepository(r.LocalPath())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if r.Remote {
-		remote, err := repo.LookupRemote("origin")
-		if err != nil {
-			return err
-		}
-		remote.SetCallbacks(&git.RemoteCallbacks{
-			CertificateCheckCallback: gitCertificateCheckCallback,
-			CredentialsCallback:      gitCredentialsCallback,
-		})
-		err = remote.Fetch(nil, nil, "")
-		if err != nil {
-			return err
+		if err = fetchOrigin(repo); err != nil {
+			return nil, err
 		}
 	}
 
-	oid, err := git.NewOid(rev)
+	oid, err := git.NewOid(b.Rev)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	commit, err := repo.LookupCommit(oid)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if b.Author == "" {
+		author := commit.Author()
+		b.Author = fmt.Sprintf("%s <%s>", author.Name, author.Email)
+		b.Message = commit.Message()
 	}
 	tree, err := commit.Tree()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = repo.CheckoutTree(tree, &git.CheckoutOpts{
@@ -89,63 +268,45 @@ func (r *Repository) StartBuild(rev string) error {
 	})
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// TODO: how to notify users of errors that ocurred before the build started
-	// to execute?
-	build := NewRunningBuild(&Build{
-		RepositoryId: r.Id,
-		Rev:          rev,
-		State:        BuildRunning,
-		Path:         directory,
-		StartedAt:    time.Now(),
-	})
-	RunningBuilds.Add(build)
-	SaveBuild(build.Build)
-	defer RunningBuilds.Remove(build.Rev)
-	defer SaveBuild(build.Build)
-	defer func() { build.FinishedAt = time.Now() }()
-
-	script := filepath.Join(build.Path, "Seafile")
-
-	cmd := exec.Command(script)
-	cmd.Stdout = build.Buffer
-	cmd.Stderr = build.Buffer
-	defer func() {
-		build.Buffer.End()
-		build.Output = build.Buffer.Bytes()
-	}()
-
-	err = cmd.Start()
+	config, err := LoadBuildConfig(directory)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	waitResult := make(chan error)
-	go func() { waitResult <- cmd.Wait() }()
-
-	select {
-	case err = <-waitResult:
-		if err == nil {
-			build.State = BuildSuccess
-		} else if exit, ok := err.(*exec.ExitError); ok {
-			build.State = BuildFailed
-			ws := exit.ProcessState.Sys().(syscall.WaitStatus) // will panic if not Unix
-			build.ReturnCode = ws.ExitStatus()
-		} else {
-			panic(err)
-		}
-	case <-build.cancel:
-		err = syscall.Kill(cmd.Process.Pid, syscall.SIGKILL)
-		// ESRCH: process already finished
-		if err != nil && err != syscall.ESRCH {
-			return err
+	if b.ParentId == 0 && config != nil {
+		if envs := config.MatrixEnvs(); len(envs) > 0 {
+			log.Printf("Build #%d of %q expanded into %d jobs", b.Number, r.Name, len(envs))
+			EnqueueJobs(b, envs)
+			return nil, nil
 		}
-		build.State = BuildCanceled
+	}
+	secrets, err := RepositorySecrets(r.Id)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	b.Path = directory
+	return &BuildJob{
+		Build:      b,
+		Repository: r,
+		Config:     config,
+		Secrets:    secrets,
+		Timeout:    r.Timeout(),
+	}, nil
+}
+
+func fetchOrigin(repo *git.Repository) error {
+	remote, err := repo.LookupRemote("origin")
+	if err != nil {
+		return err
+	}
+	remote.SetCallbacks(&git.RemoteCallbacks{
+		CertificateCheckCallback: gitCertificateCheckCallback,
+		CredentialsCallback:      gitCredentialsCallback,
+	})
+	return remote.Fetch(nil, nil, "")
 }
 
 func gitCertificateCheckCallback(cert *git.Certificate, valid bool, hostname string) git.ErrorCode {
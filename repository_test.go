@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestRemoveRepositoryTwice(t *testing.T) {
+	teardown := setupTestDB(t)
+	defer teardown()
+	repo := &Repository{Name: "removed"}
+	if err := StartRepository(repo); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveRepository(repo); err != nil {
+		t.Fatal(err)
+	}
+	if FindRepository(repo.Id) != nil {
+		t.Error("repository still found after removing it")
+	}
+	if err := RemoveRepository(repo); err != ErrRepositoryNotFound {
+		t.Errorf("removing it again returned %v, want ErrRepositoryNotFound", err)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Variables of the server environment passed on to builds, anything else
+// (credentials, tokens) is left out
+var baseEnv = [...]string{
+	"PATH",
+	"HOME",
+	"USER",
+	"LOGNAME",
+	"SHELL",
+	"LANG",
+	"LC_ALL",
+	"TZ",
+	"TMPDIR",
+}
+
+// Environment of the build processes. Later entries take precedence.
+func buildEnv(repo *Repository, build *Build, secrets map[string]string) []string {
+	var env []string
+	for _, key := range baseEnv {
+		if value, ok := os.LookupEnv(key); ok {
+			env = append(env, key+"="+value)
+		}
+	}
+	for key, value := range repo.Env {
+		env = append(env, key+"="+value)
+	}
+	for key, value := range secrets {
+		env = append(env, key+"="+value)
+	}
+	for key, value := range build.Env {
+		env = append(env, key+"="+value)
+	}
+
+	directory, err := filepath.Abs(build.Path)
+	if err != nil {
+		directory = build.Path
+	}
+	branch := ""
+	if strings.HasPrefix(build.Ref, "refs/heads/") {
+		branch = build.RefName()
+	}
+	env = append(env,
+		"SEA=true",
+		"SEA_BUILD_ID="+strconv.Itoa(build.Id),
+		"SEA_BUILD_NUMBER="+strconv.Itoa(build.Number),
+		"SEA_BUILD_JOB="+strconv.Itoa(build.Job),
+		"SEA_REPO_ID="+strconv.Itoa(repo.Id),
+		"SEA_REPO_NAME="+repo.Name,
+		"SEA_REV="+build.Rev,
+		"SEA_REF="+build.Ref,
+		"SEA_BRANCH="+branch,
+		"SEA_BUILD_DIR="+directory,
+		"SEA_BUILD_URL="+Config.BaseUrl+build.Url(),
+	)
+	return env
+}
+
+// The processes of one build, started by executor on build.Path. Results are
+// recorded on build and the output, with secrets masked, written to output.
+type buildRun struct {
+	build    *Build
+	output   io.Writer
+	executor Executor
+	env      []string
+	secrets  []string
+	cancel   <-chan struct{}
+	abort    <-chan struct{} // stops always steps of a canceled build
+	timeout  <-chan time.Time
+
+	// Called after each step finishes, may be nil
+	stepDone func()
+}
+
+// Runs the steps of config, or the Seafile when there are none
+func (r *buildRun) run(config *BuildConfig) (err error) {
+	if config != nil && len(config.Steps) > 0 {
+		return r.runSteps(config.Steps)
+	}
+	argv := []string{filepath.Join(r.build.Path, "Seafile")}
+	r.build.State, r.build.ReturnCode, err = r.process(argv, r.env, r.output, r.cancel, r.timeout)
+	return
+}
+
+// Runs each step in order, recording their results on the build
+func (r *buildRun) runSteps(steps []StepConfig) error {
+	build := r.build
+	state := BuildSuccess
+	returnCode := 0
+	for _, step := range steps {
+		result := StepResult{
+			Name:         step.Name,
+			AllowFailure: step.AllowFailure,
+		}
+		if state != BuildSuccess && !step.Always {
+			result.Skipped = true
+			build.Steps = append(build.Steps, result)
+			continue
+		}
+
+		fmt.Fprintf(r.output, "==> %s\n", step.Name)
+		env := append([]string(nil), r.env...)
+		for key, value := range step.Env {
+			env = append(env, key+"="+value)
+		}
+
+		// The build's deadline may have passed already, always steps get
+		// Config.AlwaysGrace. After a cancel only an abort stops them.
+		cancel, timeout := r.cancel, r.timeout
+		if state != BuildSuccess {
+			timeout = time.After(Config.AlwaysGrace)
+		}
+		if state == BuildCanceled {
+			cancel = r.abort
+		}
+
+		var output bytes.Buffer
+		var err error
+		result.StartedAt = time.Now()
+		argv := []string{"/bin/sh", "-c", step.Run}
+		result.State, result.ReturnCode, err = r.process(argv, env, io.MultiWriter(r.output, &output), cancel, timeout)
+		result.FinishedAt = time.Now()
+		result.Output = output.Bytes()
+		build.Steps = append(build.Steps, result)
+		if err != nil {
+			return err
+		}
+		if r.stepDone != nil {
+			r.stepDone()
+		}
+
+		if result.State == BuildFailed && step.AllowFailure {
+			fmt.Fprintf(r.output, "==> %s failed with $? = %d, failure allowed\n", step.Name, result.ReturnCode)
+		} else if result.State != BuildSuccess && state == BuildSuccess {
+			state = result.State
+			returnCode = result.ReturnCode
+		}
+	}
+	build.State = state
+	build.ReturnCode = returnCode
+	return nil
+}
+
+// Runs argv through the executor until it finishes, is canceled or times out
+func (r *buildRun) process(argv []string, env []string, output io.Writer, cancel <-chan struct{}, timeout <-chan time.Time) (BuildState, int, error) {
+	cmd, cleanup, err := r.executor.Command(r.build.Path, argv, env)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cleanup()
+	out := newRedactor(output, r.secrets)
+	defer out.Flush()
+	return runProcess(cmd, out, cancel, timeout)
+}
+
+// Runs cmd in a new process group, writing its stdout and stderr to output.
+// When cancel is closed or timeout fires the whole group is stopped. Returns
+// only after every process of the group is gone and the output was drained.
+func runProcess(cmd *exec.Cmd, output io.Writer, cancel <-chan struct{}, timeout <-chan time.Time) (state BuildState, returnCode int, err error) {
+	// Children inherit the pipe, using an *os.File makes cmd.Wait return as
+	// soon as the main process exits instead of waiting for all of them
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err = cmd.Start()
+	writer.Close()
+	if err != nil {
+		reader.Close()
+		return
+	}
+	pgid := cmd.Process.Pid
+
+	drained := make(chan struct{})
+	go func() {
+		io.Copy(output, reader)
+		reader.Close()
+		close(drained)
+	}()
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	var exitErr error
+	finished := false
+	select {
+	case exitErr = <-exited:
+		finished = true
+	case <-cancel:
+		state = BuildCanceled
+	case <-timeout:
+		state = BuildTimedOut
+	}
+
+	// Also stops background processes left behind by a finished script,
+	// which usually leaves none
+	if !finished || groupAlive(pgid) {
+		if err = stopProcessGroup(pgid); err != nil {
+			return
+		}
+	}
+	if !finished {
+		<-exited
+	}
+	<-drained
+
+	if !finished {
+		return
+	}
+	if exitErr == nil {
+		state = BuildSuccess
+	} else if exit, ok := exitErr.(*exec.ExitError); ok {
+		state = BuildFailed
+		ws := exit.ProcessState.Sys().(syscall.WaitStatus) // will panic if not Unix
+		returnCode = ws.ExitStatus()
+	} else {
+		err = exitErr
+	}
+	return
+}
+
+// Sends SIGTERM to the process group, then SIGKILL if any of its processes
+// is still alive after Config.KillGrace.
+func stopProcessGroup(pgid int) error {
+	err := syscall.Kill(-pgid, syscall.SIGTERM)
+	// ESRCH: all processes already finished
+	if err == syscall.ESRCH {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(Config.KillGrace)
+	for time.Now().Before(deadline) {
+		if !groupAlive(pgid) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	err = syscall.Kill(-pgid, syscall.SIGKILL)
+	if err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// Whether a process of the group is still running. Zombies don't count, their
+// parent may not reap them right away. Without /proc any process counts.
+func groupAlive(pgid int) bool {
+	if syscall.Kill(-pgid, 0) == syscall.ESRCH {
+		return false
+	}
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil || len(stats) == 0 {
+		return true
+	}
+	for _, file := range stats {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue // exited meanwhile
+		}
+		// pid (comm) state ppid pgrp ..., comm may have spaces and parens
+		fields := strings.Fields(string(data[bytes.LastIndexByte(data, ')')+1:]))
+		if len(fields) < 3 || fields[2] != strconv.Itoa(pgid) {
+			continue
+		}
+		if fields[0] != "Z" {
+			return true
+		}
+	}
+	return false
+}
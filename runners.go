@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Runs builds of repositories whose labels it offers: a local worker slot or
+// a remote agent.
+type Runner struct {
+	Name   string
+	Labels []string
+	Remote bool
+
+	seen time.Time // last contact of a remote agent
+}
+
+// Whether the runner offers every label
+func (r *Runner) Offers(labels []string) bool {
+	for _, label := range labels {
+		found := false
+		for _, l := range r.Labels {
+			if l == label {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the runner may take the build, repos indexed by id. Builds of
+// unknown repositories are taken by anyone, to fail as usual.
+func (r *Runner) Accepts(repos map[int]*Repository, build *Build) bool {
+	repo, ok := repos[build.RepositoryId]
+	return !ok || r.Offers(repo.Labels)
+}
+
+var labelRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Splits a list of labels separated by commas or spaces
+func parseLabels(list string) ([]string, error) {
+	var labels []string
+	for _, label := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !labelRegexp.MatchString(label) {
+			return nil, fmt.Errorf("invalid label %q", label)
+		}
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
+
+// flag.Value of the repeatable -runner flag, "name=label,label"
+type runnerFlags []*Runner
+
+// fmt.Stringer
+func (f *runnerFlags) String() string {
+	var runners []string
+	for _, r := range *f {
+		runners = append(runners, r.Name+"="+strings.Join(r.Labels, ","))
+	}
+	return strings.Join(runners, " ")
+}
+
+func (f *runnerFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if !labelRegexp.MatchString(parts[0]) {
+		return fmt.Errorf("invalid runner name %q", parts[0])
+	}
+	runner := &Runner{Name: parts[0]}
+	if len(parts) == 2 {
+		labels, err := parseLabels(parts[1])
+		if err != nil {
+			return err
+		}
+		runner.Labels = labels
+	}
+	*f = append(*f, runner)
+	return nil
+}
+
+type runnerList struct {
+	sync.RWMutex
+
+	// Local slots and remote agents seen lately, indexed by name. Names are
+	// unique across both, so an agent can't pass for a local runner.
+	local  map[string]*Runner
+	remote map[string]*Runner
+}
+
+var Runners = runnerList{
+	local:  make(map[string]*Runner),
+	remote: make(map[string]*Runner),
+}
+
+// Adds the runner, or refreshes a remote one. Fails when another runner
+// already has its name.
+func (l *runnerList) Register(runner *Runner) error {
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := l.local[runner.Name]; ok {
+		return fmt.Errorf("runner name %q is taken by a local runner", runner.Name)
+	}
+	runner.seen = time.Now()
+	if runner.Remote {
+		l.remote[runner.Name] = runner
+		return nil
+	}
+	if _, ok := l.remote[runner.Name]; ok {
+		return fmt.Errorf("runner name %q is taken by a remote agent", runner.Name)
+	}
+	l.local[runner.Name] = runner
+	return nil
+}
+
+// Keeps a remote agent online while it runs a build
+func (l *runnerList) Touch(name string) {
+	l.Lock()
+	if runner, ok := l.remote[name]; ok {
+		runner.seen = time.Now()
+	}
+	l.Unlock()
+}
+
+// Local runners and remote ones seen within agentTimeout, sorted by name
+func (l *runnerList) Online() []*Runner {
+	l.RLock()
+	var runners []*Runner
+	for _, runner := range l.local {
+		runners = append(runners, runner)
+	}
+	for _, runner := range l.remote {
+		if time.Since(runner.seen) < agentTimeout {
+			runners = append(runners, runner)
+		}
+	}
+	l.RUnlock()
+	sort.Sort(runnersByName(runners))
+	return runners
+}
+
+type runnersByName []*Runner
+
+// sort.Interface
+func (r runnersByName) Len() int           { return len(r) }
+func (r runnersByName) Less(i, j int) bool { return r[i].Name < r[j].Name }
+func (r runnersByName) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// A queued build that no online runner can take
+type StuckBuild struct {
+	*Build
+	Labels []string // required by the repository
+}
+
+func StuckBuilds() []StuckBuild {
+	runners := Runners.Online()
+	repos := repositoriesById()
+	var stuck []StuckBuild
+	for _, build := range QueuedBuilds() {
+		taken := false
+		for _, runner := range runners {
+			if runner.Accepts(repos, build) {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			var labels []string
+			if repo, ok := repos[build.RepositoryId]; ok {
+				labels = repo.Labels
+			}
+			stuck = append(stuck, StuckBuild{build, labels})
+		}
+	}
+	return stuck
+}
+
+// Whether an online runner offers every label
+func LabelsOffered(labels []string) bool {
+	for _, runner := range Runners.Online() {
+		if runner.Offers(labels) {
+			return true
+		}
+	}
+	return false
+}
+
+func repositoriesById() map[int]*Repository {
+	repos := make(map[int]*Repository)
+	for _, repo := range AllRepositories() {
+		repos[repo.Id] = repo
+	}
+	return repos
+}
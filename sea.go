@@ -2,31 +2,124 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 var Config struct {
 	WebAddr   string
+	BaseUrl   string
 	PipePath  string
 	DBPath    string
 	ReposPath string
+	Workers   int
+
+	RequeueAborted bool
+	BuildTimeout   time.Duration
+	KillGrace      time.Duration
+	AlwaysGrace    time.Duration
+	SecretKey      string
+
+	ArtifactsPath     string
+	ArtifactRetention time.Duration
+	CachePath         string
+	CacheLimit        int64
+
+	Executor         string
+	ContainerRuntime string
+	ContainerImage   string
+
+	AgentToken string
+	Labels     string
+	Runners    runnerFlags
+
+	ApiToken string
+
+	SmtpAddr     string
+	SmtpUser     string
+	SmtpPassword string
+	SmtpFrom     string
 }
 
 func Run() int {
 	flag.StringVar(&Config.WebAddr, "addr", ":8080", "TCP address for web server to listen on")
+	flag.StringVar(&Config.BaseUrl, "url", "", "public url of the web server, used in links sent to builds")
 	flag.StringVar(&Config.PipePath, "pipe", "./tmp/seapipe", "named pipe to listen for git hooks")
 	flag.StringVar(&Config.DBPath, "db", "./tmp/sea.db", "database file")
 	flag.StringVar(&Config.ReposPath, "repos", "./tmp/repos", "directory to store registered repositories")
+	flag.IntVar(&Config.Workers, "workers", 1, "number of builds to run concurrently on this process, besides -runner ones")
+	flag.StringVar(&Config.Labels, "labels", runtime.GOOS, "labels offered by the -workers runners")
+	flag.Var(&Config.Runners, "runner", "local runner as name=label,label, may be repeated")
+	flag.BoolVar(&Config.RequeueAborted, "requeue-aborted", false, "queue again builds interrupted by a crash")
+	flag.DurationVar(&Config.BuildTimeout, "build-timeout", time.Hour, "maximum duration of a build, 0 for no limit")
+	flag.DurationVar(&Config.KillGrace, "kill-grace", 10*time.Second, "time between SIGTERM and SIGKILL when stopping a build")
+	flag.DurationVar(&Config.AlwaysGrace, "always-grace", 10*time.Minute, "time always steps get to run after the build failed, was canceled or timed out")
+	flag.StringVar(&Config.ArtifactsPath, "artifacts", "./tmp/artifacts", "directory to store build artifacts")
+	flag.DurationVar(&Config.ArtifactRetention, "artifact-retention", 30*24*time.Hour, "how long to keep build artifacts, 0 to keep forever")
+	flag.StringVar(&Config.CachePath, "caches", "./tmp/caches", "directory to store build caches")
+	flag.Int64Var(&Config.CacheLimit, "cache-limit", 1<<30, "maximum size in bytes of each build cache, 0 for no limit")
+	flag.StringVar(&Config.Executor, "executor", "local", "default executor of builds: local, sandbox (bubblewrap) or container")
+	flag.StringVar(&Config.ContainerRuntime, "container-runtime", "docker", "docker compatible CLI used by the container executor")
+	flag.StringVar(&Config.ContainerImage, "container-image", "", "default image of the container executor")
+	flag.StringVar(&Config.AgentToken, "agent-token", os.Getenv("SEA_AGENT_TOKEN"), "token of remote agents, which receive secrets and should connect over https (default $SEA_AGENT_TOKEN)")
+	flag.StringVar(&Config.ApiToken, "api-token", os.Getenv("SEA_API_TOKEN"), "bearer token required by the /api/v1 JSON API, open like the web interface when empty (default $SEA_API_TOKEN)")
+	flag.StringVar(&Config.SmtpAddr, "smtp-addr", "", "host:port of the SMTP server for email notifications")
+	flag.StringVar(&Config.SmtpUser, "smtp-user", "", "SMTP user, no authentication when empty")
+	flag.StringVar(&Config.SmtpPassword, "smtp-password", os.Getenv("SEA_SMTP_PASSWORD"), "SMTP password (default $SEA_SMTP_PASSWORD)")
+	flag.StringVar(&Config.SmtpFrom, "smtp-from", "sea@localhost", "sender of email notifications")
+	flag.StringVar(&Config.SecretKey, "secret-key", os.Getenv("SEA_SECRET_KEY"), "key to encrypt repository secrets (default $SEA_SECRET_KEY)")
 	flag.Parse()
 
-	var err error
+	if Config.BaseUrl == "" {
+		if strings.HasPrefix(Config.WebAddr, ":") {
+			Config.BaseUrl = "http://localhost" + Config.WebAddr
+		} else {
+			Config.BaseUrl = "http://" + Config.WebAddr
+		}
+	}
+	Config.BaseUrl = strings.TrimSuffix(Config.BaseUrl, "/")
+
+	if Config.Workers < 0 {
+		log.Print("-workers can't be negative")
+		return 1
+	}
+	labels, err := parseLabels(Config.Labels)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	runners := []*Runner(Config.Runners)
+	for i := 1; i <= Config.Workers; i++ {
+		runners = append(runners, &Runner{Name: fmt.Sprintf("local-%d", i), Labels: labels})
+	}
+	if len(runners) == 0 && Config.AgentToken == "" {
+		log.Print("at least one of -workers, -runner or -agent-token is needed to run builds")
+		return 1
+	}
+	for _, runner := range runners {
+		if err = Runners.Register(runner); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+
+	if !validExecutor(Config.Executor) {
+		log.Printf("unknown executor %q", Config.Executor)
+		return 1
+	}
+
 	for _, dir := range [...]string{
 		Config.ReposPath,
+		Config.ArtifactsPath,
+		Config.CachePath,
 		filepath.Dir(Config.PipePath),
 		filepath.Dir(Config.DBPath),
 	} {
@@ -45,21 +138,38 @@ func Run() int {
 	}
 	defer DB.Close()
 
-	webErrors := WebServer()
-
 	var wg sync.WaitGroup
+	webErrors := WebServer(&wg)
 
 	quit := make(chan struct{})
 	wg.Add(1)
 	hooks, hookErrors := ListenGitHooks(&wg, quit)
+	StartWorkers(runners, &wg, quit)
+	wg.Add(1)
+	go PruneArtifacts(&wg, quit)
+
+	// Stopped after the builds, so they get to report how they finished
+	var senders sync.WaitGroup
+	flush := make(chan struct{})
+	senders.Add(1)
+	go SendCommitStatuses(&senders, flush)
+	for _, build := range ReconciledBuilds {
+		QueueCommitStatus(build)
+	}
+	senders.Add(1)
+	go SendNotifications(&senders, flush)
+	senders.Add(1)
+	go SendWebhookEvents(&senders, flush)
 
 	for {
 		select {
-		case _ = <-hooks:
+		case hook := <-hooks:
 			wg.Add(1)
 			go func() {
-				// StartLocalBuild(hook)
-				wg.Done()
+				defer wg.Done()
+				if err := StartLocalBuild(hook); err != nil {
+					log.Print("StartLocalBuild: ", err)
+				}
 			}()
 		case err := <-webErrors:
 			log.Print(err)
@@ -72,14 +182,17 @@ func Run() int {
 			close(quit)
 			RunningBuilds.CancelAll()
 			wg.Wait()
+			close(flush)
+			senders.Wait()
 			return 130
 		}
 	}
-
-	return 0
 }
 
 // TODO: prevent hook script from blocking when writing on pipe
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		os.Exit(RunAgent(os.Args[2:]))
+	}
 	os.Exit(Run())
 }
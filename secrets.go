@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+var ErrNoSecretKey = errors.New("no secret key configured, start sea with -secret-key or $SEA_SECRET_KEY")
+
+// Replaces secrets written to the build output
+const secretMask = "********"
+
+func secretsCipher() (cipher.AEAD, error) {
+	if Config.SecretKey == "" {
+		return nil, ErrNoSecretKey
+	}
+	key := sha256.Sum256([]byte(Config.SecretKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns the nonce followed by the sealed value
+func encryptSecret(value string) ([]byte, error) {
+	aead, err := secretsCipher()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, []byte(value), nil), nil
+}
+
+func decryptSecret(data []byte) (string, error) {
+	aead, err := secretsCipher()
+	if err != nil {
+		return "", err
+	}
+	if len(data) < aead.NonceSize() {
+		return "", errors.New("secret value is too short")
+	}
+	nonce, sealed := data[:aead.NonceSize()], data[aead.NonceSize():]
+	value, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", errors.New("could not decrypt secret, was the secret key changed?")
+	}
+	return string(value), nil
+}
+
+// Writer that replaces secrets with secretMask. Output is held until a
+// newline so secrets split across writes are still found, Flush must be
+// called after the last write.
+type redactor struct {
+	w       io.Writer
+	secrets [][]byte
+	maxLen  int
+	pending []byte
+}
+
+func newRedactor(w io.Writer, secrets []string) *redactor {
+	r := &redactor{w: w}
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		r.secrets = append(r.secrets, []byte(secret))
+		if len(secret) > r.maxLen {
+			r.maxLen = len(secret)
+		}
+	}
+	return r
+}
+
+func (r *redactor) redact(p []byte) []byte {
+	for _, secret := range r.secrets {
+		p = bytes.Replace(p, secret, []byte(secretMask), -1)
+	}
+	return p
+}
+
+// io.Writer
+func (r *redactor) Write(p []byte) (int, error) {
+	if len(r.secrets) == 0 {
+		return r.w.Write(p)
+	}
+	r.pending = append(r.pending, p...)
+
+	cut := bytes.LastIndexByte(r.pending, '\n') + 1
+	// Long lines are written in chunks, keeping enough of the tail to find a
+	// secret that continues on the next write
+	if cut == 0 && len(r.pending) > 4096 {
+		cut = len(r.pending) - (r.maxLen - 1)
+		for _, secret := range r.secrets {
+			for i := 0; i < len(r.pending); {
+				index := bytes.Index(r.pending[i:], secret)
+				if index < 0 {
+					break
+				}
+				start := i + index
+				if start < cut && start+len(secret) > cut {
+					cut = start
+				}
+				i = start + 1
+			}
+		}
+	}
+	if cut > 0 {
+		if _, err := r.w.Write(r.redact(r.pending[:cut])); err != nil {
+			return 0, err
+		}
+		r.pending = append(r.pending[:0], r.pending[cut:]...)
+	}
+	return len(p), nil
+}
+
+func (r *redactor) Flush() error {
+	if len(r.pending) == 0 {
+		return nil
+	}
+	_, err := r.w.Write(r.redact(r.pending))
+	r.pending = r.pending[:0]
+	return err
+}
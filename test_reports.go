@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type TestStatus uint
+
+const (
+	TestPassed TestStatus = iota
+	TestFailed
+	TestSkipped
+)
+
+var testStatusNames = [...]string{
+	"Passed",
+	"Failed",
+	"Skipped",
+}
+
+// fmt.Stringer
+func (s TestStatus) String() string {
+	return testStatusNames[s]
+}
+
+type TestResult struct {
+	Suite    string // JUnit suite or class, or Go package
+	Name     string
+	Status   TestStatus
+	Duration time.Duration
+}
+
+func (t *TestResult) FullName() string {
+	if t.Suite == "" {
+		return t.Name
+	}
+	return t.Suite + "." + t.Name
+}
+
+type TestSummary struct {
+	Passed  int `json:"passed"`
+	Failed  int `json:"failed"`
+	Skipped int `json:"skipped"`
+}
+
+func (b *Build) TestSummary() TestSummary {
+	var summary TestSummary
+	for _, test := range b.Tests {
+		switch test.Status {
+		case TestPassed:
+			summary.Passed++
+		case TestFailed:
+			summary.Failed++
+		case TestSkipped:
+			summary.Skipped++
+		}
+	}
+	return summary
+}
+
+func (b *Build) FailedTests() []TestResult {
+	var failed []TestResult
+	for _, test := range b.Tests {
+		if test.Status == TestFailed {
+			failed = append(failed, test)
+		}
+	}
+	return failed
+}
+
+// Tests failing on the build that didn't fail on the previous one
+func NewlyFailingTests(build, previous *Build) []TestResult {
+	failedBefore := make(map[string]bool)
+	if previous != nil {
+		for _, test := range previous.FailedTests() {
+			failedBefore[test.FullName()] = true
+		}
+	}
+	var tests []TestResult
+	for _, test := range build.FailedTests() {
+		if !failedBefore[test.FullName()] {
+			tests = append(tests, test)
+		}
+	}
+	return tests
+}
+
+// Parses the test reports matching the glob patterns, relative to the build
+// directory, and records their results on the build. Both JUnit XML and the
+// output of `go test -json` are accepted.
+func collectTestReports(build *Build, patterns []string) error {
+	root, err := filepath.Abs(build.Path)
+	if err != nil {
+		return err
+	}
+	for _, pattern := range patterns {
+		if filepath.IsAbs(pattern) || strings.HasPrefix(filepath.Clean(pattern), "..") {
+			return fmt.Errorf("test report %q is outside of the build directory", pattern)
+		}
+		matches, err := filepath.Glob(filepath.Join(root, pattern))
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			// Symlinks could show any file through the parse errors
+			info, err := os.Lstat(match)
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			// Directories on the way to the match may be symlinks too
+			resolved, err := resolveInside(root, match)
+			if err != nil {
+				return fmt.Errorf("test report %q: %v", pattern, err)
+			}
+			data, err := readFileNoFollow(resolved)
+			if err != nil {
+				return err
+			}
+			var tests []TestResult
+			if bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+				tests, err = parseJUnit(data)
+			} else {
+				tests, err = parseGoTestJSON(data)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %v", filepath.Base(match), err)
+			}
+			build.Tests = append(build.Tests, tests...)
+		}
+	}
+	return nil
+}
+
+type junitSuite struct {
+	Name   string       `xml:"name,attr"`
+	Cases  []junitCase  `xml:"testcase"`
+	Suites []junitSuite `xml:"testsuite"`
+}
+
+type junitCase struct {
+	Name      string    `xml:"name,attr"`
+	ClassName string    `xml:"classname,attr"`
+	Time      string    `xml:"time,attr"`
+	Failure   *struct{} `xml:"failure"`
+	Error     *struct{} `xml:"error"`
+	Skipped   *struct{} `xml:"skipped"`
+}
+
+// Accepts either a <testsuites> or a single <testsuite> root element
+func parseJUnit(data []byte) ([]TestResult, error) {
+	var root junitSuite
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	var tests []TestResult
+	var walk func(suite junitSuite)
+	walk = func(suite junitSuite) {
+		for _, c := range suite.Cases {
+			test := TestResult{Suite: c.ClassName, Name: c.Name}
+			if test.Suite == "" {
+				test.Suite = suite.Name
+			}
+			if seconds, err := strconv.ParseFloat(c.Time, 64); err == nil {
+				test.Duration = time.Duration(seconds * float64(time.Second))
+			}
+			switch {
+			case c.Failure != nil || c.Error != nil:
+				test.Status = TestFailed
+			case c.Skipped != nil:
+				test.Status = TestSkipped
+			}
+			tests = append(tests, test)
+		}
+		for _, child := range suite.Suites {
+			walk(child)
+		}
+	}
+	walk(root)
+	return tests, nil
+}
+
+// One event of `go test -json`
+type goTestEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+}
+
+func parseGoTestJSON(data []byte) ([]TestResult, error) {
+	var tests []TestResult
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		// go test also prints build errors as plain text
+		if !bytes.HasPrefix(line, []byte("{")) {
+			continue
+		}
+		var event goTestEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			return nil, err
+		}
+		if event.Test == "" {
+			continue
+		}
+		test := TestResult{
+			Suite:    event.Package,
+			Name:     event.Test,
+			Duration: time.Duration(event.Elapsed * float64(time.Second)),
+		}
+		switch event.Action {
+		case "pass":
+			test.Status = TestPassed
+		case "fail":
+			test.Status = TestFailed
+		case "skip":
+			test.Status = TestSkipped
+		default:
+			continue
+		}
+		tests = append(tests, test)
+	}
+	return tests, scanner.Err()
+}
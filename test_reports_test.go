@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func junitReport(test string) []byte {
+	return []byte(`<testsuite name="suite"><testcase name="` + test + `"/></testsuite>`)
+}
+
+func TestCollectTestReportsSkipsSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sea_reports_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	build := &Build{Path: filepath.Join(dir, "build")}
+	outside := filepath.Join(dir, "outside")
+	for _, d := range [...]string{build.Path, outside} {
+		if err = os.Mkdir(d, 0775); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string][]byte{
+		filepath.Join(build.Path, "report.xml"): junitReport("TestInside"),
+		filepath.Join(outside, "secret.xml"):    junitReport("TestOutside"),
+	}
+	for name, data := range files {
+		if err = ioutil.WriteFile(name, data, 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(build.Path, "link.xml"): filepath.Join(outside, "secret.xml"),
+		filepath.Join(build.Path, "linkdir"):  outside,
+	}
+	for name, target := range links {
+		if err = os.Symlink(target, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = collectTestReports(build, []string{"*.xml"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(build.Tests) != 1 || build.Tests[0].Name != "TestInside" {
+		t.Errorf("tests %+v, want only TestInside", build.Tests)
+	}
+
+	build.Tests = nil
+	if err = collectTestReports(build, []string{"linkdir/*.xml"}); err == nil {
+		t.Error("read a report through a symlinked directory")
+	}
+	if len(build.Tests) != 0 {
+		t.Errorf("tests %+v read from outside of the build", build.Tests)
+	}
+}
@@ -3,17 +3,24 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
-func WebServer() <-chan error {
+// Builds claimed by remote agents are counted on wg
+func WebServer(wg *sync.WaitGroup) <-chan error {
 	errors := make(chan error, 1)
 	go func() {
 		defer close(errors)
@@ -24,14 +31,57 @@ func WebServer() <-chan error {
 		router := httprouter.New()
 		router.GET("/", indexHandler)
 		router.GET("/updates", updatesHandler)
-		router.GET("/build/:rev", showHandler)
-		router.POST("/build/:rev/cancel", cancelHandler)
-		router.GET("/build/:rev/stream", streamHandler)
+		router.GET("/build/:rev", revRedirectHandler)
+		router.POST("/build/:rev/cancel", revRedirectHandler)
+		router.GET("/build/:rev/stream", revRedirectHandler)
+		router.GET("/build/:rev/artifacts/*path", revRedirectHandler)
 
-		router.GET("/repositories/new", newRepositoriesHandler)
+		router.GET("/repositories/:id", showRepositoriesHandler)
 		router.POST("/repositories", createRepositoriesHandler)
+		router.POST("/repositories/:id", updateRepositoriesHandler)
+		router.GET("/repositories/:id/edit", editRepositoriesHandler)
+		router.POST("/repositories/:id/secret", secretRepositoriesHandler)
+		router.POST("/repositories/:id/cache/clear", clearCacheRepositoriesHandler)
+		router.POST("/repositories/:id/secrets", createSecretsHandler)
+		router.POST("/repositories/:id/secrets/:name/delete", deleteSecretsHandler)
+		router.POST("/repositories/:id/notifications", createNotificationsHandler)
+		router.POST("/repositories/:id/notifications/:index/delete", deleteNotificationsHandler)
+		router.POST("/repositories/:id/builds", createBuildsHandler)
+		router.GET("/repositories/:id/builds/:number", showHandler)
+		router.POST("/repositories/:id/builds/:number/cancel", cancelHandler)
+		router.GET("/repositories/:id/builds/:number/stream", streamHandler)
+		router.GET("/repositories/:id/builds/:number/artifacts/*path", artifactsHandler)
+		router.GET("/repositories/:id/builds/:number/jobs/:job", showHandler)
+		router.POST("/repositories/:id/builds/:number/jobs/:job/cancel", cancelHandler)
+		router.GET("/repositories/:id/builds/:number/jobs/:job/stream", streamHandler)
+		router.GET("/repositories/:id/builds/:number/jobs/:job/artifacts/*path", artifactsHandler)
 		router.POST("/repositories/:id/hooks/bitbucket", bitbucketHookRepositoriesHandler)
 		router.POST("/repositories/:id/hooks/github", githubHookRepositoriesHandler)
+		router.GET("/webhooks", indexWebhooksHandler)
+		router.POST("/webhooks", createWebhooksHandler)
+		router.GET("/webhooks/:id", showWebhooksHandler)
+		router.POST("/webhooks/:id/delete", deleteWebhooksHandler)
+		router.POST("/webhooks/:id/deliveries/:delivery/redeliver", redeliverWebhooksHandler)
+
+		router.GET("/api/v1/repositories", apiHandler(apiIndexRepositoriesHandler))
+		router.POST("/api/v1/repositories", apiHandler(apiCreateRepositoriesHandler))
+		router.GET("/api/v1/repositories/:id", apiHandler(apiShowRepositoriesHandler))
+		router.PATCH("/api/v1/repositories/:id", apiHandler(apiUpdateRepositoriesHandler))
+		router.DELETE("/api/v1/repositories/:id", apiHandler(apiDeleteRepositoriesHandler))
+		router.GET("/api/v1/builds", apiHandler(apiIndexBuildsHandler))
+		router.POST("/api/v1/repositories/:id/builds", apiHandler(apiCreateBuildsHandler))
+		router.GET("/api/v1/repositories/:id/builds/:number", apiHandler(apiShowBuildsHandler))
+		router.GET("/api/v1/repositories/:id/builds/:number/log", apiHandler(apiLogBuildsHandler))
+		router.POST("/api/v1/repositories/:id/builds/:number/cancel", apiHandler(apiCancelBuildsHandler))
+		router.GET("/api/v1/repositories/:id/builds/:number/jobs/:job", apiHandler(apiShowBuildsHandler))
+		router.GET("/api/v1/repositories/:id/builds/:number/jobs/:job/log", apiHandler(apiLogBuildsHandler))
+		router.POST("/api/v1/repositories/:id/builds/:number/jobs/:job/cancel", apiHandler(apiCancelBuildsHandler))
+
+		router.POST("/agent/claim", agentHandler(claimAgentsHandler(wg)))
+		router.GET("/agent/builds/:id/source", agentHandler(sourceAgentsHandler))
+		router.POST("/agent/builds/:id/output", agentHandler(outputAgentsHandler))
+		router.PUT("/agent/builds/:id/artifacts", agentHandler(artifactsAgentsHandler))
+		router.POST("/agent/builds/:id/finish", agentHandler(finishAgentsHandler))
 
 		log.Printf("Starting web server on %v", Config.WebAddr)
 
@@ -41,39 +91,125 @@ func WebServer() <-chan error {
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	RenderHtml(w, "index", AllBuilds())
+	RenderHtml(w, "index", struct {
+		Builds  []*Build
+		Runners []*Runner
+		Stuck   []StuckBuild
+	}{
+		TopLevelBuilds(AllBuilds()),
+		Runners.Online(),
+		StuckBuilds(),
+	})
 }
 
-func showHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	build := FindBuild(ps.ByName("rev"))
+func findBuildParams(w http.ResponseWriter, r *http.Request, ps httprouter.Params) *Build {
+	repository := findRepositoryParam(w, r, ps)
+	if repository == nil {
+		return nil
+	}
+	number, err := strconv.Atoi(ps.ByName("number"))
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "Invalid `number` parameter", http.StatusBadRequest)
+		return nil
+	}
+	job := 0
+	if param := ps.ByName("job"); param != "" {
+		job, err = strconv.Atoi(param)
+		if err != nil || job < 1 {
+			http.Error(w, "Invalid `job` parameter", http.StatusBadRequest)
+			return nil
+		}
+	}
+	build := FindJob(repository.Id, number, job)
 	if build == nil {
 		http.NotFound(w, r)
-		return
 	}
-	RenderHtml(w, "show", build)
+	return build
 }
 
-func streamHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	build := FindBuild(ps.ByName("rev"))
+// Redirects the old /build/:rev routes to the most recent build of the
+// revision, within the `repository` id when given. Ambiguous prefixes list
+// the matching builds.
+func revRedirectHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	repositoryId := 0
+	if param := r.URL.Query().Get("repository"); param != "" {
+		var err error
+		if repositoryId, err = strconv.Atoi(param); err != nil {
+			http.Error(w, "Invalid `repository` parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	prefix := "/build/" + ps.ByName("rev")
+	suffix := strings.TrimPrefix(r.URL.Path, prefix)
+
+	build, err := FindBuildByRev(repositoryId, ps.ByName("rev"))
+	if ambiguous, ok := err.(*AmbiguousRevError); ok {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusMultipleChoices)
+		fmt.Fprintf(w, "<p>%s matches:</p>\n<ul>\n", template.HTMLEscapeString(ambiguous.Error()))
+		for _, candidate := range ambiguous.Candidates {
+			url := template.HTMLEscapeString(candidate.Url() + suffix)
+			fmt.Fprintf(w, "<li><a href=\"%s\">%s</a> %s</li>\n", url, url, template.HTMLEscapeString(candidate.Rev))
+		}
+		fmt.Fprint(w, "</ul>\n")
+		return
+	} else if err != nil {
+		panic(err)
+	}
 	if build == nil {
 		http.NotFound(w, r)
 		return
 	}
+	url := build.Url() + suffix
+	if r.Method == "GET" {
+		http.Redirect(w, r, url, http.StatusMovedPermanently)
+	} else {
+		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+	}
+}
 
-	if build.State != BuildRunning {
-		w.Write(build.Output)
+func showHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	build := findBuildParams(w, r, ps)
+	if build == nil {
 		return
 	}
+	var jobs []*Build
+	if build.Jobs > 0 {
+		jobs = BuildJobs(build)
+	}
+	var newlyFailing []TestResult
+	if len(build.Tests) > 0 {
+		newlyFailing = NewlyFailingTests(build, PreviousBuild(build))
+	}
+	RenderHtml(w, "show", struct {
+		*Build
+		JobList      []*Build
+		NewlyFailing []TestResult
+	}{build, jobs, newlyFailing})
+}
 
-	running, ok := RunningBuilds.Get(build.Rev)
-	if !ok {
-		panic("build state is BuildRunning but no running build was found")
+func streamHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	build := findBuildParams(w, r, ps)
+	if build == nil {
+		return
 	}
-	stream := running.Buffer.Stream()
 
+	streamOutput(w, build)
+}
+
+// Writes the output of the build, following it until the end while it runs
+func streamOutput(w http.ResponseWriter, build *Build) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 
+	running, ok := RunningBuilds.Get(build.Id)
+	if build.State != BuildRunning || !ok {
+		w.Write(build.Output)
+		return
+	}
+	stream := running.Buffer.Stream()
+
 	closed := w.(http.CloseNotifier).CloseNotify()
 	var buffer [512]byte
 	for {
@@ -91,13 +227,83 @@ func streamHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	}
 }
 
-func cancelHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	build, ok := RunningBuilds.Get(ps.ByName("rev"))
+func artifactsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	build := findBuildParams(w, r, ps)
+	if build == nil {
+		return
+	}
+	file, ok := ArtifactFile(build, ps.ByName("path"))
 	if !ok {
 		http.NotFound(w, r)
 		return
 	}
-	build.Cancel()
+	if build.ArtifactsExpired {
+		http.Error(w, "Artifacts of this build have expired", http.StatusGone)
+		return
+	}
+	// http.ServeFile would redirect .../index.html to the directory
+	f, err := os.Open(file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(filepath.Base(file)))
+	http.ServeContent(w, r, filepath.Base(file), info.ModTime(), f)
+}
+
+func cancelHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	build := findBuildParams(w, r, ps)
+	if build == nil {
+		return
+	}
+	if !CancelBuild(build) {
+		http.Error(w, "Build is not running", http.StatusConflict)
+	}
+}
+
+// Queues a manual build, either a rebuild of the revision of the `build` number
+// or of the branch, tag or revision given in `ref`.
+func createBuildsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	repository := findRepositoryParam(w, r, ps)
+	if repository == nil {
+		return
+	}
+
+	build := &Build{Trigger: TriggerManual}
+	if number := r.FormValue("build"); number != "" {
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			http.Error(w, "Invalid `build` parameter", http.StatusBadRequest)
+			return
+		}
+		previous := FindBuildByNumber(repository.Id, n)
+		if previous == nil {
+			http.NotFound(w, r)
+			return
+		}
+		build = previous.Rebuild()
+	} else if spec := strings.TrimSpace(r.FormValue("ref")); spec != "" {
+		var err error
+		build.Rev, build.Ref, err = repository.ResolveRef(spec)
+		if err != nil {
+			log.Print(err)
+			http.Error(w, fmt.Sprintf("Could not resolve %q", spec), http.StatusUnprocessableEntity)
+			return
+		}
+	} else {
+		http.Error(w, "Missing `build` or `ref` parameter", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Queueing %s (%s) of %q", build.Rev, build.Ref, repository.Name)
+	EnqueueBuild(repository, build)
+	http.Redirect(w, r, build.Url(), http.StatusSeeOther)
 }
 
 func updatesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -124,6 +330,354 @@ func newRepositoriesHandler(w http.ResponseWriter, r *http.Request, ps httproute
 	RenderHtml(w, "new_repository", nil)
 }
 
+func findRepositoryParam(w http.ResponseWriter, r *http.Request, ps httprouter.Params) *Repository {
+	id, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "Invalid `id` parameter", http.StatusBadRequest)
+		return nil
+	}
+	repository := FindRepository(id)
+	if repository == nil {
+		http.NotFound(w, r)
+	}
+	return repository
+}
+
+func showRepositoriesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	// httprouter doesn't allow a static segment next to the :id wildcard
+	if ps.ByName("id") == "new" {
+		newRepositoriesHandler(w, r, ps)
+		return
+	}
+	repository := findRepositoryParam(w, r, ps)
+	if repository == nil {
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	baseUrl := fmt.Sprintf("%s://%s/repositories/%d/hooks", scheme, r.Host, repository.Id)
+
+	RenderHtml(w, "repository", struct {
+		*Repository
+		Builds           []*Build
+		LabelsOffered    bool
+		CacheSize        int64
+		GithubHookUrl    string
+		BitbucketHookUrl string
+	}{
+		repository,
+		TopLevelBuilds(RepositoryBuilds(repository.Id)),
+		LabelsOffered(repository.Labels),
+		CacheSize(repository),
+		baseUrl + "/github",
+		baseUrl + "/bitbucket?token=" + repository.WebhookSecret,
+	})
+}
+
+func editRepositoriesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	repository := findRepositoryParam(w, r, ps)
+	if repository == nil {
+		return
+	}
+	RenderHtml(w, "edit_repository", newRepositoryForm(repository))
+}
+
+type repositoryForm struct {
+	*Repository
+	Errors          []string
+	SecretNames     []string
+	SecretsEnabled  bool
+	Executors       []string
+	DefaultExecutor string
+	StatusProviders []string
+	Channels        []string
+	Whens           []string
+}
+
+func newRepositoryForm(repository *Repository) repositoryForm {
+	return repositoryForm{
+		Repository:      repository,
+		SecretNames:     SecretNames(repository.Id),
+		SecretsEnabled:  Config.SecretKey != "",
+		Executors:       executorNames[:],
+		DefaultExecutor: Config.Executor,
+		StatusProviders: statusProviderNames[:],
+		Channels:        notificationChannels[:],
+		Whens:           notificationWhens[:],
+	}
+}
+
+func updateRepositoriesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	repository := findRepositoryParam(w, r, ps)
+	if repository == nil {
+		return
+	}
+	form := newRepositoryForm(repository)
+
+	repository.Name = strings.TrimSpace(r.FormValue("name"))
+
+	repository.BuildTimeout = 0
+	if timeout := strings.TrimSpace(r.FormValue("build_timeout")); timeout != "" {
+		var err error
+		repository.BuildTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			form.Errors = append(form.Errors, fmt.Sprintf("Invalid build timeout %q", timeout))
+		}
+	}
+
+	repository.Executor = r.FormValue("executor")
+	repository.Image = strings.TrimSpace(r.FormValue("image"))
+	repository.DisableNetwork = r.FormValue("disable_network") != ""
+	labels, err := parseLabels(r.FormValue("labels"))
+	if err != nil {
+		form.Errors = append(form.Errors, err.Error())
+	}
+	repository.Labels = labels
+
+	repository.StatusProvider = r.FormValue("status_provider")
+	repository.StatusRepo = strings.Trim(strings.TrimSpace(r.FormValue("status_repo")), "/")
+	repository.StatusApiUrl = strings.TrimSpace(r.FormValue("status_api_url"))
+	repository.StatusUser = strings.TrimSpace(r.FormValue("status_user"))
+	if r.FormValue("status_token_clear") != "" {
+		repository.StatusToken = nil
+	} else if token := r.FormValue("status_token"); token != "" {
+		// An empty field keeps the current token, it's never sent back
+		if repository.StatusToken, err = encryptSecret(token); err != nil {
+			form.Errors = append(form.Errors, err.Error())
+		}
+	}
+
+	var errs []string
+	repository.Env, errs = parseEnv(r.FormValue("env"))
+	form.Errors = append(form.Errors, errs...)
+	form.Errors = append(form.Errors, repository.Validate()...)
+
+	if len(form.Errors) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		RenderHtml(w, "edit_repository", form)
+		return
+	}
+	SaveRepository(repository)
+	// Builds may be waiting for the labels that were removed
+	notifyWorkers()
+	http.Redirect(w, r, fmt.Sprintf("/repositories/%d", repository.Id), http.StatusSeeOther)
+}
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Secret values are write-only, they can be replaced or deleted but are never
+// sent back to the browser
+func createSecretsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	repository := findRepositoryParam(w, r, ps)
+	if repository == nil {
+		return
+	}
+	form := newRepositoryForm(repository)
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if !envNameRegexp.MatchString(name) {
+		form.Errors = append(form.Errors, fmt.Sprintf("Invalid secret name %q", name))
+	} else if err := SaveSecret(repository.Id, name, r.FormValue("value")); err != nil {
+		log.Print(err)
+		form.Errors = append(form.Errors, err.Error())
+	}
+
+	if len(form.Errors) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		RenderHtml(w, "edit_repository", form)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/repositories/%d/edit", repository.Id), http.StatusSeeOther)
+}
+
+func deleteSecretsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	repository := findRepositoryParam(w, r, ps)
+	if repository == nil {
+		return
+	}
+	DeleteSecret(repository.Id, ps.ByName("name"))
+	http.Redirect(w, r, fmt.Sprintf("/repositories/%d/edit", repository.Id), http.StatusSeeOther)
+}
+
+func createNotificationsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	repository := findRepositoryParam(w, r, ps)
+	if repository == nil {
+		return
+	}
+	form := newRepositoryForm(repository)
+
+	rule := NotificationRule{
+		Channel: r.FormValue("channel"),
+		Target:  strings.TrimSpace(r.FormValue("target")),
+		When:    r.FormValue("when"),
+	}
+	if err := rule.Validate(); err != nil {
+		form.Errors = append(form.Errors, err.Error())
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		RenderHtml(w, "edit_repository", form)
+		return
+	}
+	repository.Notifications = append(repository.Notifications, rule)
+	SaveRepository(repository)
+	http.Redirect(w, r, fmt.Sprintf("/repositories/%d/edit", repository.Id), http.StatusSeeOther)
+}
+
+func deleteNotificationsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	repository := findRepositoryParam(w, r, ps)
+	if repository == nil {
+		return
+	}
+	index, err := strconv.Atoi(ps.ByName("index"))
+	if err != nil || index < 0 || index >= len(repository.Notifications) {
+		http.NotFound(w, r)
+		return
+	}
+	repository.Notifications = append(repository.Notifications[:index], repository.Notifications[index+1:]...)
+	SaveRepository(repository)
+	http.Redirect(w, r, fmt.Sprintf("/repositories/%d/edit", repository.Id), http.StatusSeeOther)
+}
+
+type webhooksPage struct {
+	Webhooks []*Webhook
+	Events   []string
+	Errors   []string
+}
+
+func indexWebhooksHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	RenderHtml(w, "webhooks", webhooksPage{AllWebhooks(), eventNames[:], nil})
+}
+
+func createWebhooksHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	r.ParseForm()
+	hook := &Webhook{
+		Url:    strings.TrimSpace(r.FormValue("url")),
+		Secret: strings.TrimSpace(r.FormValue("secret")),
+	}
+	if hook.Secret == "" {
+		hook.Secret = NewWebhookSecret()
+	}
+	var errs []string
+	if !strings.HasPrefix(hook.Url, "http://") && !strings.HasPrefix(hook.Url, "https://") {
+		errs = append(errs, fmt.Sprintf("Invalid url %q", hook.Url))
+	}
+	for _, event := range r.Form["events"] {
+		if !containsString(eventNames[:], event) {
+			errs = append(errs, fmt.Sprintf("Unknown event %q", event))
+		}
+		hook.Events = append(hook.Events, event)
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		RenderHtml(w, "webhooks", webhooksPage{AllWebhooks(), eventNames[:], errs})
+		return
+	}
+	SaveWebhook(hook)
+	http.Redirect(w, r, fmt.Sprintf("/webhooks/%d", hook.Id), http.StatusSeeOther)
+}
+
+func findWebhookParam(w http.ResponseWriter, r *http.Request, ps httprouter.Params) *Webhook {
+	id, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		http.Error(w, "Invalid `id` parameter", http.StatusBadRequest)
+		return nil
+	}
+	hook := FindWebhook(id)
+	if hook == nil {
+		http.NotFound(w, r)
+	}
+	return hook
+}
+
+func showWebhooksHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	hook := findWebhookParam(w, r, ps)
+	if hook == nil {
+		return
+	}
+	RenderHtml(w, "webhook", struct {
+		*Webhook
+		Deliveries []*Delivery
+	}{hook, WebhookDeliveries(hook.Id)})
+}
+
+func deleteWebhooksHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	hook := findWebhookParam(w, r, ps)
+	if hook == nil {
+		return
+	}
+	DeleteWebhook(hook.Id)
+	http.Redirect(w, r, "/webhooks", http.StatusSeeOther)
+}
+
+// Sends the payload of a past delivery again, as a new delivery
+func redeliverWebhooksHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	hook := findWebhookParam(w, r, ps)
+	if hook == nil {
+		return
+	}
+	id, err := strconv.Atoi(ps.ByName("delivery"))
+	if err != nil {
+		http.Error(w, "Invalid `delivery` parameter", http.StatusBadRequest)
+		return
+	}
+	delivery := FindDelivery(hook.Id, id)
+	if delivery == nil {
+		http.NotFound(w, r)
+		return
+	}
+	QueueDelivery(&Delivery{
+		WebhookId:  hook.Id,
+		Event:      delivery.Event,
+		Payload:    delivery.Payload,
+		Redelivery: true,
+	})
+	http.Redirect(w, r, fmt.Sprintf("/webhooks/%d", hook.Id), http.StatusSeeOther)
+}
+
+// Parses KEY=value lines, ignoring blank ones and # comments
+func parseEnv(text string) (map[string]string, []string) {
+	env := make(map[string]string)
+	var errs []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" || strings.ContainsAny(key, " \t") {
+			errs = append(errs, fmt.Sprintf("Invalid environment variable %q", line))
+			continue
+		}
+		env[key] = parts[1]
+	}
+	return env, errs
+}
+
+func clearCacheRepositoriesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	repository := findRepositoryParam(w, r, ps)
+	if repository == nil {
+		return
+	}
+	if err := ClearCache(repository); err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/repositories/%d", repository.Id), http.StatusSeeOther)
+}
+
+func secretRepositoriesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	repository := findRepositoryParam(w, r, ps)
+	if repository == nil {
+		return
+	}
+	repository.WebhookSecret = NewWebhookSecret()
+	SaveRepository(repository)
+	http.Redirect(w, r, fmt.Sprintf("/repositories/%d", repository.Id), http.StatusSeeOther)
+}
+
 func createRepositoriesHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	remote := false
 	if len(r.FormValue("remote")) > 0 {
@@ -131,18 +685,19 @@ func createRepositoriesHandler(w http.ResponseWriter, r *http.Request, _ httprou
 	}
 
 	repo := &Repository{
-		Name:   strings.TrimSpace(r.FormValue("name")),
-		Remote: remote,
-		Url:    strings.TrimSpace(r.FormValue("url")),
+		Name:          strings.TrimSpace(r.FormValue("name")),
+		Remote:        remote,
+		Url:           strings.TrimSpace(r.FormValue("url")),
+		WebhookSecret: NewWebhookSecret(),
 	}
 
-	log.Printf("repo: %#v", repo)
 	valid := (len(repo.Name) > 0) && (!repo.Remote || len(repo.Url) > 0)
 	if valid {
 		err := StartRepository(repo)
 		if err != nil {
 			panic(err)
 		}
+		EmitRepositoryEvent(EventRepositoryCreated, repo)
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	} else {
 		RenderHtml(w, "new_repository", repo)
@@ -150,31 +705,116 @@ func createRepositoriesHandler(w http.ResponseWriter, r *http.Request, _ httprou
 }
 
 func bitbucketHookRepositoriesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	id, err := strconv.Atoi(ps.ByName("id"))
+	repository := findRepositoryParam(w, r, ps)
+	if repository == nil {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Print(err)
-		http.Error(w, "Invalid `id` parameter", http.StatusBadRequest)
+		http.Error(w, "Could not read payload", http.StatusBadRequest)
 		return
 	}
-	repository := FindRepository(id)
-	if repository == nil {
-		http.NotFound(w, r)
+	if !verifyBitbucketHook(repository, r, body) {
+		log.Printf("Invalid Bitbucket hook token or signature for %q from %s", repository.Name, r.RemoteAddr)
+		http.Error(w, "Invalid token or signature", http.StatusUnauthorized)
 		return
 	}
-	rawJson := r.FormValue("payload")
-	var data interface{}
-	json.Unmarshal([]byte(rawJson), &data)
-	root := data.(map[string]interface{})
-	commitList := root["commits"].([]interface{})
-	lastCommit := commitList[len(commitList)-1].(map[string]interface{})
-	commitRev := lastCommit["raw_node"].(string)
-
-	go func() {
-		err := repository.StartBuild(commitRev)
-		if err != nil {
-			log.Print("Repository.StartBuild: ", err)
+	rawJson, err := hookPayload(r, body)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "Could not read payload", http.StatusBadRequest)
+		return
+	}
+	if event := r.Header.Get("X-Event-Key"); event != "" && event != "repo:push" {
+		http.Error(w, fmt.Sprintf("Unsupported event %q", event), http.StatusBadRequest)
+		return
+	}
+	refs, err := parseBitbucketPayload(r, rawJson)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	if len(refs) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	for _, ref := range refs {
+		if !validRev(ref.Rev) {
+			http.Error(w, fmt.Sprintf("Invalid revision %q", ref.Rev), http.StatusBadRequest)
+			return
 		}
-	}()
+	}
+
+	for _, ref := range refs {
+		log.Printf("Queueing %s (%s) of %q", ref.Rev, ref.Ref, repository.Name)
+		EnqueueBuild(repository, ref.Build(TriggerBitbucket))
+	}
+	w.WriteHeader(http.StatusAccepted)
 }
 
-func githubHookRepositoriesHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {}
+func githubHookRepositoriesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	repository := findRepositoryParam(w, r, ps)
+	if repository == nil {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "Could not read payload", http.StatusBadRequest)
+		return
+	}
+	if !verifyGithubHook(repository, r, body) {
+		log.Printf("Invalid GitHub hook signature for %q from %s", repository.Name, r.RemoteAddr)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	switch event := r.Header.Get("X-GitHub-Event"); event {
+	case "ping":
+		fmt.Fprintln(w, "pong")
+		return
+	case "push":
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported event %q", event), http.StatusBadRequest)
+		return
+	}
+
+	payload, err := hookPayload(r, body)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "Could not read payload", http.StatusBadRequest)
+		return
+	}
+	var push githubPushEvent
+	if err = json.Unmarshal(payload, &push); err != nil {
+		log.Print(err)
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+
+	if push.Deleted || push.After == nullRev {
+		log.Printf("Ref %s deleted from %q, nothing to build", push.Ref, repository.Name)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if push.After == "" {
+		http.Error(w, "Missing `after` revision", http.StatusBadRequest)
+		return
+	}
+
+	if push.Forced {
+		log.Printf("Ref %s of %q was force-pushed from %s", push.Ref, repository.Name, push.Before)
+	}
+
+	ref := push.pushedRef()
+	if !validRev(ref.Rev) {
+		http.Error(w, fmt.Sprintf("Invalid revision %q", ref.Rev), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Queueing %s (%s) of %q", ref.Rev, ref.Ref, repository.Name)
+	EnqueueBuild(repository, ref.Build(TriggerGitHub))
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Runs the test in a scratch directory with its own database
+func setupTestDB(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "sea_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Builds are checked out under ./tmp
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range [...]string{"tmp", "repos", "artifacts", "caches", "agent"} {
+		if err = os.Mkdir(sub, 0775); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Config.DBPath = filepath.Join(dir, "sea.db")
+	Config.ReposPath = filepath.Join(dir, "repos")
+	Config.ArtifactsPath = filepath.Join(dir, "artifacts")
+	Config.CachePath = filepath.Join(dir, "caches")
+	Config.Executor = "local"
+	Config.KillGrace = time.Second
+	if err = InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		DB.Close()
+		os.Chdir(cwd)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestArtifactsHandlerIndexHtml(t *testing.T) {
+	defer setupTestDB(t)()
+
+	repo := &Repository{Name: "artifacts-test"}
+	SaveRepository(repo)
+	build := &Build{
+		RepositoryId: repo.Id,
+		State:        BuildSuccess,
+		Artifacts:    []Artifact{{Path: "cov/index.html", Size: 17}},
+	}
+	SaveBuild(build)
+	stored := filepath.Join(artifactsDir(build), "cov", "index.html")
+	if err := os.MkdirAll(filepath.Dir(stored), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(stored, []byte("<html>cov</html>\n"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range [...]string{"/cov/index.html", "/cov/", "/cov/missing.html"} {
+		r, _ := http.NewRequest("GET", build.Url()+"/artifacts"+path, nil)
+		w := httptest.NewRecorder()
+		artifactsHandler(w, r, httprouter.Params{
+			{Key: "id", Value: strconv.Itoa(repo.Id)},
+			{Key: "number", Value: strconv.Itoa(build.Number)},
+			{Key: "path", Value: path},
+		})
+		if path != "/cov/index.html" {
+			if w.Code != http.StatusNotFound {
+				t.Errorf("%s: answered %d, want 404", path, w.Code)
+			}
+			continue
+		}
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: answered %d (Location %q), want 200", path, w.Code, w.Header().Get("Location"))
+		}
+		if body := w.Body.String(); body != "<html>cov</html>\n" {
+			t.Errorf("%s: body %q", path, body)
+		}
+	}
+}
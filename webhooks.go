@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Subset of the GitHub push event payload, see github-example.json
+type githubPushEvent struct {
+	After      string `json:"after"`
+	Before     string `json:"before"`
+	Ref        string `json:"ref"`
+	Created    bool   `json:"created"`
+	Deleted    bool   `json:"deleted"`
+	Forced     bool   `json:"forced"`
+	HeadCommit *struct {
+		Id      string `json:"id"`
+		Message string `json:"message"`
+		Author  struct {
+			Name  string `json:"name"`
+			Email string `json:"email"`
+		} `json:"author"`
+	} `json:"head_commit"`
+}
+
+func (e *githubPushEvent) pushedRef() pushedRef {
+	ref := pushedRef{
+		Ref:    e.Ref,
+		OldRev: e.Before,
+		Rev:    e.After,
+	}
+	// For annotated tags `after` is the tag object, head_commit is what it points to
+	if e.HeadCommit != nil && e.HeadCommit.Id != "" {
+		ref.Rev = e.HeadCommit.Id
+		ref.Author = fmt.Sprintf("%s <%s>", e.HeadCommit.Author.Name, e.HeadCommit.Author.Email)
+		ref.Message = e.HeadCommit.Message
+	}
+	return ref
+}
+
+// Legacy Bitbucket POST service payload, see bitbucket-example
+type bitbucketServicePayload struct {
+	Commits []struct {
+		RawNode   string   `json:"raw_node"`
+		Branch    string   `json:"branch"`
+		Branches  []string `json:"branches"`
+		RawAuthor string   `json:"raw_author"`
+		Message   string   `json:"message"`
+	} `json:"commits"`
+}
+
+// Subset of the Bitbucket Cloud 2.0 repo:push event payload
+type bitbucketPushEvent struct {
+	Push struct {
+		Changes []struct {
+			Old *bitbucketRef `json:"old"`
+			New *bitbucketRef `json:"new"`
+		} `json:"changes"`
+	} `json:"push"`
+}
+
+type bitbucketRef struct {
+	Type   string `json:"type"` // branch, tag or annotated_tag
+	Name   string `json:"name"`
+	Target struct {
+		Hash    string `json:"hash"`
+		Message string `json:"message"`
+		Author  struct {
+			Raw string `json:"raw"`
+		} `json:"author"`
+	} `json:"target"`
+}
+
+// A ref updated by a push, as received from a webhook
+type pushedRef struct {
+	Ref     string
+	OldRev  string
+	Rev     string
+	Author  string
+	Message string
+}
+
+func (p *pushedRef) Build(trigger BuildTrigger) *Build {
+	return &Build{
+		Rev:     p.Rev,
+		OldRev:  p.OldRev,
+		Ref:     p.Ref,
+		Trigger: trigger,
+		Author:  p.Author,
+		Message: p.Message,
+	}
+}
+
+// Returns the head of each pushed branch. Commits are sent from oldest to
+// newest, so the last one seen on a branch is its head.
+func (p *bitbucketServicePayload) pushedRefs() []pushedRef {
+	var refs []pushedRef
+	index := make(map[string]int)
+	for _, commit := range p.Commits {
+		if commit.RawNode == "" {
+			continue
+		}
+		branches := commit.Branches
+		if commit.Branch != "" {
+			branches = append(branches, commit.Branch)
+		}
+		for _, branch := range branches {
+			ref := pushedRef{
+				Ref:     "refs/heads/" + branch,
+				Rev:     commit.RawNode,
+				Author:  commit.RawAuthor,
+				Message: commit.Message,
+			}
+			if i, ok := index[branch]; ok {
+				refs[i] = ref
+			} else {
+				index[branch] = len(refs)
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return refs
+}
+
+// Returns the new head of each created or updated ref, deleted ones are
+// skipped.
+func (e *bitbucketPushEvent) pushedRefs() []pushedRef {
+	var refs []pushedRef
+	for _, change := range e.Push.Changes {
+		if change.New == nil || change.New.Target.Hash == "" {
+			continue
+		}
+		ref := pushedRef{
+			Ref:     "refs/heads/" + change.New.Name,
+			Rev:     change.New.Target.Hash,
+			Author:  change.New.Target.Author.Raw,
+			Message: change.New.Target.Message,
+		}
+		if change.New.Type != "branch" {
+			ref.Ref = "refs/tags/" + change.New.Name
+		}
+		if change.Old != nil {
+			ref.OldRev = change.Old.Target.Hash
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// Decodes either a 2.0 repo:push event or a legacy POST service payload.
+func parseBitbucketPayload(r *http.Request, payload []byte) ([]pushedRef, error) {
+	if r.Header.Get("X-Event-Key") != "" {
+		var event bitbucketPushEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		return event.pushedRefs(), nil
+	}
+	var service bitbucketServicePayload
+	if err := json.Unmarshal(payload, &service); err != nil {
+		return nil, err
+	}
+	return service.pushedRefs(), nil
+}
+
+// Extracts the hook payload from the request body, it can be sent either as
+// is or url-encoded in the "payload" form field.
+func hookPayload(r *http.Request, body []byte) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		return body, nil
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(form.Get("payload")), nil
+}
+
+func NewWebhookSecret() string {
+	var secret [20]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(secret[:])
+}
+
+// Checks a "sha256=<hex digest>" signature of body, as sent by GitHub in the
+// X-Hub-Signature-256 header.
+func validSignature(secret string, body []byte, signature string) bool {
+	if secret == "" || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	received, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(received, mac.Sum(nil))
+}
+
+func validToken(secret string, token string) bool {
+	if secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(token)) == 1
+}
+
+func verifyGithubHook(repo *Repository, r *http.Request, body []byte) bool {
+	return validSignature(repo.WebhookSecret, body, r.Header.Get("X-Hub-Signature-256"))
+}
+
+// Bitbucket services can't sign requests, so the secret is passed in the
+// `token` query parameter of the hook url. Webhooks configured with a secret
+// are signed like GitHub's.
+func verifyBitbucketHook(repo *Repository, r *http.Request, body []byte) bool {
+	if signature := r.Header.Get("X-Hub-Signature"); signature != "" {
+		return validSignature(repo.WebhookSecret, body, signature)
+	}
+	return validToken(repo.WebhookSecret, r.URL.Query().Get("token"))
+}